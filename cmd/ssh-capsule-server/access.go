@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A capsule can keep clients out by their key or their network. The optional
+// access file in the capsule directory has deny and allow rules for the
+// capsule and for each group. A rule is a key fingerprint, as shown by
+// ssh-keygen -l or as the name of the account's home, or a network in CIDR
+// form or a single address. The message is what blocked clients are told:
+//
+// deny SHA256:mVPwvezndPv/ARoIadVY98vAC0g+P/5633yTC4d/Nx0
+// deny 203.0.113.0/24
+// message 61 access denied: write to abuse@example.com
+// group editor allow 192.0.2.0/24
+//
+// A client is kept out when a deny rule matches its key or its address. When
+// there are allow rules for keys the key must match one of them and when
+// there are allow rules for networks the address must be in one of them. A
+// client that a group keeps out only loses the group's commands.
+
+const (
+	ACCESS_DENIED_EXIT_STATUS = 61
+	DEFAULT_ACCESS_MESSAGE    = "61 access denied"
+)
+
+type accessList struct {
+	denyKeys  map[string]bool
+	denyNets  []*net.IPNet
+	allowKeys map[string]bool
+	allowNets []*net.IPNet
+	rules     []string
+}
+
+func newAccessList() *accessList {
+	return &accessList{denyKeys: map[string]bool{}, allowKeys: map[string]bool{}}
+}
+
+// Add a deny or allow rule
+func (al *accessList) add(kind string, rule string) error {
+	if kind != "deny" && kind != "allow" {
+		return fmt.Errorf("unknown rule %q", kind)
+	}
+	al.rules = append(al.rules, kind+" "+rule)
+
+	// Fingerprints are kept in the form of account names
+	if account, ok := parseFingerprint(rule); ok {
+		if kind == "deny" {
+			al.denyKeys[account] = true
+		} else {
+			al.allowKeys[account] = true
+		}
+		return nil
+	}
+
+	nets, err := parseNetworks([]string{rule})
+	if err != nil {
+		return err
+	}
+	if kind == "deny" {
+		al.denyNets = append(al.denyNets, nets...)
+	} else {
+		al.allowNets = append(al.allowNets, nets...)
+	}
+	return nil
+}
+
+// Whether the client with the account and address is let in. A nil list
+// lets everyone in.
+func (al *accessList) permits(account string, addr net.Addr) bool {
+	if al == nil {
+		return true
+	}
+	if al.denyKeys[account] || containsAddr(al.denyNets, addr) {
+		return false
+	}
+	if len(al.allowKeys) > 0 && !al.allowKeys[account] {
+		return false
+	}
+	if len(al.allowNets) > 0 && !containsAddr(al.allowNets, addr) {
+		return false
+	}
+	return true
+}
+
+func readAccess(capsulePath string) (*accessList, map[string]*accessList, string, error) {
+	groupAccess := map[string]*accessList{}
+
+	af := filepath.Join(capsulePath, "access")
+	lines, err := readLines(af)
+	if os.IsNotExist(err) {
+		return nil, groupAccess, "", nil
+	} else if err != nil {
+		return nil, nil, "", err
+	}
+
+	var access *accessList
+	message := ""
+	for i, l := range lines {
+		if len(strings.TrimSpace(l)) == 0 || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		fields := strings.Fields(l)
+		if fields[0] == "message" {
+			message = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(l), "message"))
+			continue
+		}
+
+		al := access
+		if fields[0] == "group" && len(fields) >= 2 {
+			al = groupAccess[fields[1]]
+			if al == nil {
+				al = newAccessList()
+				groupAccess[fields[1]] = al
+			}
+			fields = fields[2:]
+		} else if al == nil {
+			access = newAccessList()
+			al = access
+		}
+
+		if len(fields) != 2 {
+			return nil, nil, "", fmt.Errorf("%s:%d: invalid rule %q", af, i+1, l)
+		}
+		if err := al.add(fields[0], fields[1]); err != nil {
+			return nil, nil, "", fmt.Errorf("%s:%d: %s", af, i+1, err)
+		}
+	}
+
+	return access, groupAccess, message, nil
+}
+
+// Whether the client can use the capsule at all
+func (cp *capsulePolicy) admits(account string, addr net.Addr) bool {
+	return cp.access.permits(account, addr)
+}
+
+// A copy of the capsule policy for a session of the client with the groups
+// that it is a member of, except those that keep it out.
+func (cp *capsulePolicy) forClient(account string, addr net.Addr) *capsulePolicy {
+	denied := map[string]bool{}
+	for g, al := range cp.groupAccess {
+		if !al.permits(account, addr) {
+			denied[g] = true
+		}
+	}
+
+	ccp := *cp
+	ccp.memberOf = cp.sessionGroups(account, addr, denied)
+	return &ccp
+}
+
+// The message for clients that the capsule keeps out
+func (cp *capsulePolicy) accessMessage() string {
+	if cp.accessDenied == "" {
+		return DEFAULT_ACCESS_MESSAGE
+	}
+	return cp.accessDenied
+}
+
+func accessLines(cp *capsulePolicy) []string {
+	lines := []string{}
+	if cp.access != nil {
+		lines = append(lines, cp.access.rules...)
+	}
+	for g, al := range cp.groupAccess {
+		for _, r := range al.rules {
+			lines = append(lines, "group "+g+" "+r)
+		}
+	}
+	if cp.accessDenied != "" {
+		lines = append(lines, "message "+cp.accessDenied)
+	}
+	sort.Strings(lines)
+	return lines
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAccessList(t *testing.T) {
+	key := testKey(t)
+	account := accountName(key)
+	other := accountName(testKey(t))
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 50312}
+	elsewhere := &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 50312}
+	socket := &net.UnixAddr{Name: "/run/capsule.sock", Net: "unix"}
+
+	var none *accessList
+	if !none.permits(account, addr) {
+		t.Errorf("a missing list kept a client out")
+	}
+
+	tests := []struct {
+		rules  []string
+		client string
+		addr   net.Addr
+		want   bool
+	}{
+		{[]string{"deny " + account}, account, addr, false},
+		{[]string{"deny " + account}, other, addr, true},
+		// Fingerprints as ssh-keygen shows them match too
+		{[]string{"deny SHA256:" + strings.NewReplacer("-", "+", "_", "/").Replace(account)}, account, addr, false},
+		{[]string{"deny 192.0.2.0/24"}, other, addr, false},
+		{[]string{"deny 192.0.2.7"}, other, elsewhere, true},
+		{[]string{"allow " + account}, other, addr, false},
+		{[]string{"allow " + account}, account, elsewhere, true},
+		{[]string{"allow 192.0.2.0/24"}, account, elsewhere, false},
+		{[]string{"allow 192.0.2.0/24"}, account, socket, false},
+		{[]string{"allow " + account, "allow 192.0.2.0/24"}, account, addr, true},
+		{[]string{"allow " + account, "allow 192.0.2.0/24"}, account, elsewhere, false},
+		{[]string{"allow 192.0.2.0/24", "deny " + account}, account, addr, false},
+	}
+	for _, tt := range tests {
+		al := newAccessList()
+		for _, r := range tt.rules {
+			fields := strings.Fields(r)
+			if err := al.add(fields[0], fields[1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := al.permits(tt.client, tt.addr); got != tt.want {
+			t.Errorf("%q permits %s at %s = %v, want %v", tt.rules, tt.client[:8], tt.addr, got, tt.want)
+		}
+	}
+
+	al := newAccessList()
+	for _, r := range [][2]string{{"block", "192.0.2.1"}, {"deny", "example.com"}, {"allow", "192.0.2.0/40"}} {
+		if err := al.add(r[0], r[1]); err == nil {
+			t.Errorf("%q was added", r)
+		}
+	}
+}
+
+func TestReadAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if access, groups, message, err := readAccess(dir); access != nil || len(groups) != 0 || message != "" || err != nil {
+		t.Errorf("without an access file got %v, %v, %q, %v", access, groups, message, err)
+	}
+
+	account, other := accountName(testKey(t)), accountName(testKey(t))
+	writeCapsule(t, dir, map[string]string{
+		"access": "# rules\n\ndeny 203.0.113.0/24\nmessage 61 access denied: write to abuse@example.com\ngroup editor allow " + account + "\n",
+	})
+	access, groups, message, err := readAccess(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message != "61 access denied: write to abuse@example.com" {
+		t.Errorf("message %q", message)
+	}
+	cp := &capsulePolicy{
+		access:       access,
+		groupAccess:  groups,
+		accessDenied: message,
+		groups: map[string][]*groupEntry{
+			account: {{groups: []string{"editor"}}},
+			other:   {{groups: []string{"editor"}}},
+		},
+		commands: map[string][]*commandTemplate{
+			"commands":        {{line: "tpl"}},
+			"commands-editor": {{line: "sftp -w /"}},
+		},
+	}
+	if want := []string{"deny 203.0.113.0/24", "group editor allow " + account, "message " + message}; !reflect.DeepEqual(accessLines(cp), want) {
+		t.Errorf("accessLines = %q", accessLines(cp))
+	}
+
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 50312}
+	if cp.admits(account, &net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 22}) || !cp.admits(account, addr) {
+		t.Errorf("the capsule's rules weren't applied")
+	}
+
+	// A client that the group keeps out only loses the group's commands
+	if got := templateLines(cp.forClient(account, addr).templates()); len(got) != 2 {
+		t.Errorf("the group's key has %q", got)
+	}
+	if got := templateLines(cp.forClient(other, addr).templates()); !reflect.DeepEqual(got, []string{"tpl"}) {
+		t.Errorf("a key that the group keeps out has %q", got)
+	}
+	if cp.memberOf != nil {
+		t.Errorf("the capsule's policy was changed")
+	}
+
+	if (&capsulePolicy{}).accessMessage() != DEFAULT_ACCESS_MESSAGE {
+		t.Errorf("no default message")
+	}
+
+	for _, l := range []string{"deny", "group editor deny", "deny 192.0.2.1 now", "permit 192.0.2.1"} {
+		writeCapsule(t, dir, map[string]string{"access": "\n" + l + "\n"})
+		if _, _, _, err := readAccess(dir); err == nil || !strings.Contains(err.Error(), "access:2:") {
+			t.Errorf("%q gave %v, want an error with its line", l, err)
+		}
+	}
+}
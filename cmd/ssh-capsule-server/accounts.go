@@ -0,0 +1,105 @@
+package main
+
+import (
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Every public key is an account the first time that it is used. There is
+// no signup, the account is identified by the key's SHA256 fingerprint and
+// it can have a home directory in the capsule's homes directory. The home is
+// only created when a command needs it, either through a <home> or
+// <home-path> argument or as a command from the capsule's bin directory.
+
+// The key's fingerprint as it can be used in a file name. It is the same
+// as the fingerprint shown by ssh-keygen -l except for the SHA256: prefix
+// and using '-' and '_' in place of '+' and '/'.
+func accountName(key ssh.PublicKey) string {
+	fp := strings.TrimPrefix(gossh.FingerprintSHA256(key), "SHA256:")
+	return strings.NewReplacer("+", "-", "/", "_").Replace(fp)
+}
+
+// The account of a fingerprint written as SHA256:<base64>, as ssh-keygen -l
+// shows it, or in the form of an account name.
+func parseFingerprint(s string) (string, bool) {
+	isAccount := len(s) == 43 && strings.Trim(s, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_") == ""
+	if strings.HasPrefix(s, "SHA256:") || isAccount {
+		return strings.NewReplacer("+", "-", "/", "_").Replace(strings.TrimPrefix(s, "SHA256:")), true
+	}
+	return "", false
+}
+
+// The home directory of the account in this capsule, or an empty string if
+// the capsule doesn't have homes.
+func (cp *capsulePolicy) accountHome(account string) string {
+	if cp.homes == "" || account == "" {
+		return ""
+	}
+	return filepath.Join(realDir(cp.homes), account)
+}
+
+// A copy of the capsule policy for a session of the account with the home
+// directory added as a mount. The home mount has no place in the virtual
+// tree, its files are shown to the visitor as ~/path.
+func (cp *capsulePolicy) forAccount(account string) *capsulePolicy {
+	home := cp.accountHome(account)
+	if home == "" {
+		return cp
+	}
+
+	acp := *cp
+	acp.home = home
+	acp.mounts = append(append([]mount{}, cp.mounts...), mount{virtual: "~", physical: home, real: home})
+	return &acp
+}
+
+// Convert a ~/path in the account's home into a physical path, or an empty
+// string if the path isn't permitted. Other paths are left to the <path>
+// templates so that the two can't be mistaken for each other.
+func (cp *capsulePolicy) resolveHome(p string) string {
+	if cp.home == "" || (p != "~" && !strings.HasPrefix(p, "~/")) {
+		return ""
+	}
+	p = p[1:]
+
+	hp, err := confinePath(cp.home, cleanVirtualPath(p), nil)
+	if err != nil {
+		log.Printf("Path refused: %s\n", err)
+		return ""
+	}
+	return hp
+}
+
+// Create the account's home directory if it doesn't exist yet, owned by the
+// user that runs the capsule's commands.
+func (cp *capsulePolicy) createHome(owner *credential) error {
+	if cp.home == "" {
+		return nil
+	}
+	if _, err := os.Stat(cp.home); err == nil {
+		return nil
+	}
+	log.Printf("Creating account home: %s\n", cp.home)
+	if owner == nil {
+		return os.MkdirAll(cp.home, 0700)
+	}
+
+	// Other users can pass through the homes but not list them
+	homes := filepath.Dir(cp.home)
+	if err := os.MkdirAll(homes, 0711); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(homes); err == nil && fi.Mode().Perm()&0111 != 0111 {
+		if err := os.Chmod(homes, fi.Mode().Perm()|0111); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(cp.home, 0700); err != nil {
+		return err
+	}
+	return os.Chown(cp.home, int(owner.uid), int(owner.gid))
+}
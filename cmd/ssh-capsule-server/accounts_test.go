@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func testKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestAccountName(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		name := accountName(testKey(t))
+		if len(name) != 43 || strings.ContainsAny(name, "+/=:") {
+			t.Errorf("account name %q can't be used as a file name", name)
+		}
+	}
+}
+
+func TestAccountHome(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links need privileges on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir = realDir(dir)
+
+	cp := testCapsule(t, filepath.Join(dir, "content"))
+	if acp := cp.forAccount("acct"); acp != cp || acp.resolveHome("~/f") != "" {
+		t.Errorf("a capsule without homes gave the account a home")
+	}
+
+	cp.homes = filepath.Join(dir, "homes")
+	acp := cp.forAccount("acct")
+	home := filepath.Join(dir, "homes", "acct")
+	if acp.home != home || len(acp.mounts) != len(cp.mounts)+1 {
+		t.Fatalf("home is %q with mounts %v", acp.home, acp.mounts)
+	}
+	if cp.home != "" {
+		t.Errorf("the capsule's policy was changed")
+	}
+
+	if err := acp.createHome(nil); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(home); err != nil || !info.IsDir() || info.Mode().Perm() != 0700 {
+		t.Errorf("home was created as %v, %v", info, err)
+	}
+
+	os.MkdirAll(filepath.Join(dir, "outside"), 0755)
+	if err := os.Symlink(filepath.Join(dir, "outside"), filepath.Join(home, "evil")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "content"), filepath.Join(home, "site")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"~", home},
+		{"~/f", filepath.Join(home, "f")},
+		{"~/a/../f", filepath.Join(home, "f")},
+		{"~/../other/f", filepath.Join(home, "other/f")},
+		{"f", ""},
+		{"/f", ""},
+		{"~other/f", ""},
+		{"~/evil/f", ""},
+		// Trusted links and mounts don't apply inside of homes
+		{"~/site/f", ""},
+	}
+	for _, tt := range tests {
+		if got := acp.resolveHome(tt.path); got != tt.want {
+			t.Errorf("resolveHome(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+
+	// The home is only written through the home mount
+	if err := ioutil.WriteFile(filepath.Join(home, "f"), []byte("data\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := acp.readFile(filepath.Join(home, "f")); err != nil || string(b) != "data\n" {
+		t.Errorf("reading ~/f gave %q, %v", b, err)
+	}
+	if _, err := cp.readFile(filepath.Join(home, "f")); err == nil {
+		t.Errorf("another account read ~/f")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With --audit-log every session is written to the file as one line of JSON
+// when it ends, with who connected, what they asked for, how the capsule's
+// policy resolved it and how it finished. Each session has its own random ID
+// while the connection ID is the same for all of a connection's sessions.
+//
+// {"time":"2021-07-01T12:00:00Z","session":"9c0e5b7d21a4f386",
+//  "connection":"4a1f...","remote":"192.0.2.1:50312",
+//  "fingerprint":"SHA256:...","host":"example.com","capsule":"example",
+//  "requested":["cat","/main.gmi"],"template":"cat <path>",
+//  "commands_file":"commands","command":["cat","/srv/example/content/main.gmi"],
+//  "exit":0,"bytes_in":0,"bytes_out":1324,"duration":0.004}
+
+const AUDIT_SESSION_ID_BYTES = 8
+
+type auditRecord struct {
+	Time         time.Time `json:"time"`
+	Session      string    `json:"session"`
+	Connection   string    `json:"connection"`
+	Remote       string    `json:"remote"`
+	Fingerprint  string    `json:"fingerprint"`
+	Host         string    `json:"host"`
+	Capsule      string    `json:"capsule,omitempty"`
+	Requested    []string  `json:"requested"`
+	Subsystem    string    `json:"subsystem,omitempty"`
+	Template     string    `json:"template,omitempty"`
+	CommandsFile string    `json:"commands_file,omitempty"`
+	Command      []string  `json:"command,omitempty"`
+	Backend      string    `json:"backend,omitempty"`
+	Exit         *int      `json:"exit"`
+	BytesIn      int64     `json:"bytes_in"`
+	BytesOut     int64     `json:"bytes_out"`
+	Duration     float64   `json:"duration"`
+}
+
+type auditWriter struct {
+	mutex sync.Mutex
+	f     *os.File
+}
+
+var auditLog *auditWriter
+
+func openAuditLog(path string) (*auditWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditWriter{f: f}, nil
+}
+
+func (aw *auditWriter) write(r *auditRecord) {
+	// Templates are easier to read without their <> escaped
+	b := &bytes.Buffer{}
+	enc := json.NewEncoder(b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(r); err != nil {
+		log.Printf("ERROR: %s\n", err)
+		return
+	}
+
+	aw.mutex.Lock()
+	defer aw.mutex.Unlock()
+	if _, err := aw.f.Write(b.Bytes()); err != nil {
+		log.Printf("ERROR: audit log: %s\n", err)
+	}
+}
+
+// A session that records its bytes and exit status for the audit log
+type auditSession struct {
+	ssh.Session
+	record   auditRecord
+	allowed  bool
+	start    time.Time
+	bytesIn  int64
+	bytesOut int64
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
+
+func newSessionID() string {
+	b := make([]byte, AUDIT_SESSION_ID_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("ERROR: %s\n", err)
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+func startAudit(s ssh.Session) *auditSession {
+	as := &auditSession{Session: s, start: time.Now()}
+	as.record = auditRecord{
+		Time:       as.start.UTC(),
+		Session:    newSessionID(),
+		Connection: fmt.Sprint(s.Context().Value(ssh.ContextKeySessionID)),
+		Remote:     s.RemoteAddr().String(),
+		Host:       sessionHost(s),
+		Requested:  s.Command(),
+		Subsystem:  s.Subsystem(),
+	}
+	if s.PublicKey() != nil {
+		as.record.Fingerprint = gossh.FingerprintSHA256(s.PublicKey())
+	}
+	if as.record.Requested == nil {
+		as.record.Requested = []string{}
+	}
+	metrics.sessionStarted()
+	return as
+}
+
+func (as *auditSession) Read(b []byte) (int, error) {
+	n, err := as.Session.Read(b)
+	atomic.AddInt64(&as.bytesIn, int64(n))
+	return n, err
+}
+
+func (as *auditSession) Write(b []byte) (int, error) {
+	n, err := as.Session.Write(b)
+	atomic.AddInt64(&as.bytesOut, int64(n))
+	return n, err
+}
+
+func (as *auditSession) Stderr() io.ReadWriter {
+	return struct {
+		io.Reader
+		io.Writer
+	}{as.Session.Stderr(), countingWriter{as.Session.Stderr(), &as.bytesOut}}
+}
+
+func (as *auditSession) Exit(code int) error {
+	as.record.Exit = &code
+	return as.Session.Exit(code)
+}
+
+// Note the capsule that answered the session
+func (as *auditSession) capsule(cp *capsulePolicy) {
+	as.record.Capsule = cp.name
+}
+
+// Note the template that allowed the command and what it resolved to
+func (as *auditSession) matched(t *commandTemplate, cmd []string) {
+	as.allowed = true
+	if t != nil {
+		as.record.Template = t.line
+		as.record.CommandsFile = t.file
+	}
+	as.record.Command = append([]string{}, cmd...)
+}
+
+// Note the backend that the session was forwarded to
+func (as *auditSession) forwarded(b *backend) {
+	as.allowed = true
+	as.record.Backend = b.address
+}
+
+// Write the session to the audit log and metrics once it has ended
+func (as *auditSession) finish() {
+	as.record.BytesIn = atomic.LoadInt64(&as.bytesIn)
+	as.record.BytesOut = atomic.LoadInt64(&as.bytesOut)
+	as.record.Duration = time.Since(as.start).Seconds()
+	metrics.sessionEnded(&as.record, as.allowed)
+	if auditLog != nil {
+		auditLog.write(&as.record)
+	}
+}
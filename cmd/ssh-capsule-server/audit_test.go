@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gliderlabs/ssh"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A session from a client with what the audit log records
+type auditTestSession struct {
+	processSession
+	key  ssh.PublicKey
+	exit int
+}
+
+func (s *auditTestSession) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50312}
+}
+func (s *auditTestSession) Environ() []string        { return []string{"HOST=example.com"} }
+func (s *auditTestSession) Command() []string        { return []string{"cat", "/main.gmi"} }
+func (s *auditTestSession) Subsystem() string        { return "" }
+func (s *auditTestSession) PublicKey() ssh.PublicKey { return s.key }
+func (s *auditTestSession) Exit(code int) error      { s.exit = code; return nil }
+func (s *auditTestSession) Context() context.Context {
+	return context.WithValue(context.Background(), ssh.ContextKeySessionID, "conn")
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(aw *auditWriter) { auditLog = aw }(auditLog)
+	auditLog, err = openAuditLog(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		s := &auditTestSession{processSession: *newProcessSession("in"), key: testKey(t)}
+		as := startAudit(s)
+		as.capsule(&capsulePolicy{name: "example"})
+		as.matched(&commandTemplate{line: "cat <path>", file: "commands"}, []string{"cat", "/srv/main.gmi"})
+		io.Copy(as, as)
+		io.WriteString(as.Stderr(), "err")
+		as.Exit(3)
+		as.finish()
+		if s.exit != 3 || s.stdout.String() != "in" || s.stderr.String() != "err" {
+			t.Errorf("the session gave %d, %q, %q", s.exit, s.stdout.String(), s.stderr.String())
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("the log has %d lines", len(lines))
+	}
+	if !strings.Contains(lines[0], `"template":"cat <path>"`) {
+		t.Errorf("the template is escaped in %s", lines[0])
+	}
+
+	r := auditRecord{}
+	if err := json.Unmarshal([]byte(lines[0]), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Connection != "conn" || r.Remote != "192.0.2.1:50312" || r.Host != "example.com" || r.Capsule != "example" || !strings.HasPrefix(r.Fingerprint, "SHA256:") {
+		t.Errorf("the session was recorded as %+v", r)
+	}
+	if r.CommandsFile != "commands" || strings.Join(r.Requested, " ") != "cat /main.gmi" || strings.Join(r.Command, " ") != "cat /srv/main.gmi" {
+		t.Errorf("the command was recorded as %+v", r)
+	}
+	if r.Exit == nil || *r.Exit != 3 || r.BytesIn != 2 || r.BytesOut != 5 {
+		t.Errorf("the session ended with %v, %d in, %d out", r.Exit, r.BytesIn, r.BytesOut)
+	}
+
+	r2 := auditRecord{}
+	if err := json.Unmarshal([]byte(lines[1]), &r2); err != nil || len(r.Session) != 2*AUDIT_SESSION_ID_BYTES || r2.Session == r.Session {
+		t.Errorf("sessions %q and %q, %v", r.Session, r2.Session, err)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A capsule can be served by another capsule server instead of a local
+// directory. The optional backend file in the capsule directory has the
+// backend's address, its host key and optionally the private key that this
+// server uses to log in, otherwise its own host key:
+//
+// address backend.example.com:1966
+// host-key ssh-ed25519 AAAA...
+// identity /srv/frontend/id_ed25519
+//
+// The whole session is forwarded: the command or subsystem, the client's
+// environment, stdin, stdout, stderr and the exit status. The client's key
+// and address go in CAPSULE_CLIENT_KEY and CAPSULE_CLIENT_ADDRESS, which the
+// backend only believes when the session logs in with one of its
+// --frontend-keys.
+
+const (
+	PROXY_ERROR_EXIT_STATUS = 43
+	BACKEND_DIAL_TIMEOUT    = 10 * time.Second
+
+	CLIENT_KEY_ENV     = "CAPSULE_CLIENT_KEY"
+	CLIENT_ADDRESS_ENV = "CAPSULE_CLIENT_ADDRESS"
+)
+
+type backend struct {
+	address string
+	hostKey gossh.PublicKey
+	signer  gossh.Signer
+}
+
+func (b *backend) String() string {
+	if b == nil {
+		return "local"
+	}
+	return b.address + " " + gossh.FingerprintSHA256(b.hostKey)
+}
+
+func newBackend(address string, hostKey string, identity string) (*backend, error) {
+	b := &backend{address: address}
+	if address == "" {
+		return nil, fmt.Errorf("backend address is required")
+	}
+
+	var err error
+	b.hostKey, _, _, _, err = gossh.ParseAuthorizedKey([]byte(hostKey))
+	if err != nil {
+		return nil, fmt.Errorf("backend host key: %s", err)
+	}
+
+	if identity == "" {
+		identity = CLI.HostKey
+	}
+	pem, err := ioutil.ReadFile(identity)
+	if err != nil {
+		return nil, err
+	}
+	if b.signer, err = gossh.ParsePrivateKey(pem); err != nil {
+		return nil, fmt.Errorf("%s: %s", identity, err)
+	}
+
+	return b, nil
+}
+
+func readBackend(capsulePath string) (*backend, error) {
+	bf := filepath.Join(capsulePath, "backend")
+	lines, err := readLines(bf)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	settings := map[string]string{}
+	for i, l := range lines {
+		if len(strings.TrimSpace(l)) == 0 || strings.HasPrefix(l, "#") {
+			continue
+		}
+		fields := strings.SplitN(strings.TrimSpace(l), " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: invalid setting %q", bf, i+1, l)
+		}
+		switch fields[0] {
+		case "address", "host-key", "identity":
+			settings[fields[0]] = strings.TrimSpace(fields[1])
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown setting %q", bf, i+1, fields[0])
+		}
+	}
+
+	b, err := newBackend(settings["address"], settings["host-key"], settings["identity"])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", bf, err)
+	}
+	return b, nil
+}
+
+// Forward the session to the backend, returning the exit status
+func forwardSession(s ssh.Session, b *backend) int {
+	client, err := gossh.Dial("tcp", b.address, &gossh.ClientConfig{
+		User:            s.User(),
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(b.signer)},
+		HostKeyCallback: gossh.FixedHostKey(b.hostKey),
+		Timeout:         BACKEND_DIAL_TIMEOUT,
+	})
+	if err != nil {
+		log.Printf("ERROR: backend %s: %s\n", b.address, err)
+		io.WriteString(s.Stderr(), "43 proxy error: capsule unavailable\n")
+		return PROXY_ERROR_EXIT_STATUS
+	}
+	defer client.Close()
+
+	ch, reqs, err := client.OpenChannel("session", nil)
+	if err != nil {
+		log.Printf("ERROR: backend %s: %s\n", b.address, err)
+		io.WriteString(s.Stderr(), "43 proxy error: capsule unavailable\n")
+		return PROXY_ERROR_EXIT_STATUS
+	}
+	defer ch.Close()
+
+	// The client can't claim to be someone else with the variables
+	env := [][2]string{}
+	for _, e := range s.Environ() {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 || parts[0] == CLIENT_KEY_ENV || parts[0] == CLIENT_ADDRESS_ENV {
+			continue
+		}
+		env = append(env, [2]string{parts[0], parts[1]})
+	}
+	env = append(env, [2]string{CLIENT_KEY_ENV, sessionPublicKey(s)})
+	env = append(env, [2]string{CLIENT_ADDRESS_ENV, s.RemoteAddr().String()})
+	for _, e := range env {
+		ch.SendRequest("env", false, gossh.Marshal(&struct{ Name, Value string }{e[0], e[1]}))
+	}
+
+	var ok bool
+	if s.Subsystem() != "" {
+		ok, err = ch.SendRequest("subsystem", true, gossh.Marshal(&struct{ Name string }{s.Subsystem()}))
+	} else if s.RawCommand() != "" {
+		ok, err = ch.SendRequest("exec", true, gossh.Marshal(&struct{ Command string }{s.RawCommand()}))
+	} else {
+		ok, err = ch.SendRequest("shell", true, nil)
+	}
+	if err == nil && !ok {
+		err = fmt.Errorf("request refused")
+	}
+	if err != nil {
+		log.Printf("ERROR: backend %s: %s\n", b.address, err)
+		io.WriteString(s.Stderr(), "43 proxy error: capsule unavailable\n")
+		return PROXY_ERROR_EXIT_STATUS
+	}
+
+	// The backend's exit status arrives as a request on the channel
+	status := PROXY_ERROR_EXIT_STATUS
+	requestsDone := make(chan struct{})
+	go func() {
+		defer close(requestsDone)
+		for req := range reqs {
+			if req.Type == "exit-status" && len(req.Payload) == 4 {
+				status = int(binary.BigEndian.Uint32(req.Payload))
+			}
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}()
+
+	go func() {
+		io.Copy(ch, s)
+		ch.CloseWrite()
+	}()
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-s.Context().Done():
+			client.Close()
+		case <-finished:
+		}
+	}()
+
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		io.Copy(s.Stderr(), ch.Stderr())
+	}()
+	io.Copy(s, ch)
+	<-stderrDone
+
+	// The requests end when the backend closes the channel
+	<-requestsDone
+	return status
+}
+
+// The public keys of the front-end servers that can forward sessions here
+var frontendKeys = map[string]bool{}
+
+func readFrontendKeys(keys []string) error {
+	for _, k := range keys {
+		pk, _, _, _, err := gossh.ParseAuthorizedKey([]byte(k))
+		if err != nil {
+			return fmt.Errorf("frontend key: %s", err)
+		}
+		frontendKeys[pk.Type()+" "+base64.StdEncoding.EncodeToString(pk.Marshal())] = true
+	}
+	return nil
+}
+
+// A session forwarded by a front-end, with the client's key and address
+type forwardedSession struct {
+	ssh.Session
+	key  ssh.PublicKey
+	addr net.Addr
+}
+
+func (fs *forwardedSession) PublicKey() ssh.PublicKey {
+	return fs.key
+}
+
+func (fs *forwardedSession) RemoteAddr() net.Addr {
+	return fs.addr
+}
+
+// The session as the client sees it, even when it came through a front-end
+func clientSession(s ssh.Session) ssh.Session {
+	if s.PublicKey() == nil || !frontendKeys[sessionPublicKey(s)] {
+		return s
+	}
+
+	fs := &forwardedSession{Session: s, addr: s.RemoteAddr()}
+	for _, e := range s.Environ() {
+		if strings.HasPrefix(e, CLIENT_KEY_ENV+"=") {
+			pk, _, _, _, err := gossh.ParseAuthorizedKey([]byte(e[len(CLIENT_KEY_ENV)+1:]))
+			if err != nil {
+				log.Printf("ERROR: forwarded key: %s\n", err)
+				continue
+			}
+			fs.key = pk
+		} else if strings.HasPrefix(e, CLIENT_ADDRESS_ENV+"=") {
+			if a, err := net.ResolveTCPAddr("tcp", e[len(CLIENT_ADDRESS_ENV)+1:]); err == nil {
+				fs.addr = a
+			}
+		}
+	}
+	if fs.key == nil {
+		return s
+	}
+	return fs
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write a new private key to the file, returning its signer
+func testIdentity(t *testing.T, file string) gossh.Signer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(file, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.ParsePrivateKey(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func authorizedKey(k gossh.PublicKey) string {
+	return strings.TrimSpace(string(gossh.MarshalAuthorizedKey(k)))
+}
+
+func TestReadBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if b, err := readBackend(dir); b != nil || err != nil {
+		t.Errorf("without a backend file got %v, %v", b, err)
+	}
+
+	identity := filepath.Join(dir, "id_rsa")
+	signer := testIdentity(t, identity)
+	hostKey := authorizedKey(testKey(t))
+	writeCapsule(t, dir, map[string]string{
+		"backend": "# the backend\naddress backend.example.com:1966\nhost-key " + hostKey + "\nidentity " + identity + "\n",
+	})
+	b, err := readBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.address != "backend.example.com:1966" || authorizedKey(b.hostKey) != hostKey || authorizedKey(b.signer.PublicKey()) != authorizedKey(signer.PublicKey()) {
+		t.Errorf("backend is %s", b)
+	}
+
+	for _, l := range []string{
+		"host-key " + hostKey + "\nidentity " + identity,
+		"address backend.example.com:1966\nhost-key bogus\nidentity " + identity,
+		"address backend.example.com:1966\nhost-key " + hostKey + "\nidentity " + filepath.Join(dir, "missing"),
+		"address",
+		"port 1966",
+	} {
+		writeCapsule(t, dir, map[string]string{"backend": l + "\n"})
+		if _, err := readBackend(dir); err == nil {
+			t.Errorf("%q was read", l)
+		}
+	}
+}
+
+func TestClientSession(t *testing.T) {
+	defer func(keys map[string]bool) { frontendKeys = keys }(frontendKeys)
+	frontendKeys = map[string]bool{}
+
+	frontend, client := testKey(t), testKey(t)
+	if err := readFrontendKeys([]string{authorizedKey(frontend)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := readFrontendKeys([]string{"bogus"}); err == nil {
+		t.Errorf("a bad front-end key was read")
+	}
+
+	env := []string{CLIENT_KEY_ENV + "=" + authorizedKey(client), CLIENT_ADDRESS_ENV + "=198.51.100.7:50312"}
+	s := clientSession(&backendTestSession{key: frontend, env: env})
+	if sessionPublicKey(s) != sessionPublicKey(&backendTestSession{key: client}) || s.RemoteAddr().String() != "198.51.100.7:50312" {
+		t.Errorf("the front-end's session is from %s at %s", sessionPublicKey(s), s.RemoteAddr())
+	}
+
+	// Anyone else can't claim to be another client
+	other := &backendTestSession{key: testKey(t), env: env}
+	if s := clientSession(other); s != other {
+		t.Errorf("another key's session was taken as forwarded")
+	}
+}
+
+// A client's session on the front-end
+type backendTestSession struct {
+	processSession
+	key ssh.PublicKey
+	env []string
+}
+
+func (s *backendTestSession) User() string             { return "capsule" }
+func (s *backendTestSession) PublicKey() ssh.PublicKey { return s.key }
+func (s *backendTestSession) Environ() []string        { return s.env }
+func (s *backendTestSession) RawCommand() string       { return "cat /index.gmi" }
+func (s *backendTestSession) Subsystem() string        { return "" }
+func (s *backendTestSession) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50312}
+}
+
+func TestForwardSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	frontend := testIdentity(t, filepath.Join(dir, "frontend"))
+	backendHost := testIdentity(t, filepath.Join(dir, "backend"))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &ssh.Server{
+		Handler: func(s ssh.Session) {
+			io.WriteString(s, strings.Join(s.Command(), " ")+"\n")
+			io.WriteString(s, strings.Join(s.Environ(), "\n")+"\n")
+			io.Copy(s.Stderr(), s)
+			s.Exit(7)
+		},
+		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
+			return ssh.KeysEqual(key, frontend.PublicKey())
+		},
+	}
+	server.AddHostKey(backendHost)
+	go server.Serve(l)
+	defer server.Close()
+
+	client := testKey(t)
+	s := &backendTestSession{
+		processSession: *newProcessSession("input"),
+		key:            client,
+		env:            []string{"LANG=en", CLIENT_KEY_ENV + "=spoofed"},
+	}
+	b := &backend{address: l.Addr().String(), hostKey: backendHost.PublicKey(), signer: frontend}
+	if code := forwardSession(s, b); code != 7 {
+		t.Errorf("exit status %d, want 7", code)
+	}
+	out := s.stdout.String()
+	if !strings.HasPrefix(out, "cat /index.gmi\n") || !strings.Contains(out, "LANG=en\n") || strings.Contains(out, "spoofed") {
+		t.Errorf("the backend got %q", out)
+	}
+	if !strings.Contains(out, CLIENT_KEY_ENV+"="+authorizedKey(client)) || !strings.Contains(out, CLIENT_ADDRESS_ENV+"=192.0.2.1:50312") {
+		t.Errorf("the backend didn't get the client in %q", out)
+	}
+	if s.stderr.String() != "input" {
+		t.Errorf("stderr %q", s.stderr.String())
+	}
+
+	// A backend with another host key isn't trusted
+	s = &backendTestSession{processSession: *newProcessSession(""), key: client}
+	b.hostKey = testKey(t)
+	if code := forwardSession(s, b); code != PROXY_ERROR_EXIT_STATUS || !strings.HasPrefix(s.stderr.String(), "43 proxy error") {
+		t.Errorf("an untrusted backend gave %d, %q", code, s.stderr.String())
+	}
+}
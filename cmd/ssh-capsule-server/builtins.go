@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Built-in replacements for common file commands. These never run an
+// external program and produce the same output on every host with paths
+// shown relative to the capsule instead of the server's filesystem.
+//
+// Usage:
+// ls [-l] [-g] <path>...
+// cat <path>...
+// wc [-l] [-w] [-c] <path>...
+//
+
+// Split the leading single letter options from the paths
+func builtinFlags(args []string, allowed string) (map[rune]bool, []string, error) {
+	flags := map[rune]bool{}
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+		a := args[0]
+		args = args[1:]
+		if a == "--" {
+			break
+		}
+		for _, f := range a[1:] {
+			if !strings.ContainsRune(allowed, f) {
+				return nil, nil, fmt.Errorf("invalid option -- '%c'", f)
+			}
+			flags[f] = true
+		}
+	}
+	return flags, args, nil
+}
+
+// The target of a gemtext link to the virtual path, with each segment
+// escaped so that names with spaces or other special characters still work
+func gemtextLink(vp string) string {
+	segments := strings.Split(vp, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func lsEntry(w io.Writer, info os.FileInfo, vp string, long bool, gemtext bool) {
+	name := info.Name()
+	if info.IsDir() {
+		name += "/"
+		if vp != "/" {
+			vp += "/"
+		}
+	}
+
+	switch {
+	case gemtext:
+		fmt.Fprintf(w, "=> %s %s\n", gemtextLink(vp), name)
+	case long:
+		kind := "-"
+		if info.IsDir() {
+			kind = "d"
+		} else if info.Mode()&os.ModeSymlink != 0 {
+			kind = "l"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", kind, info.Size(), info.ModTime().UTC().Format(time.RFC3339), vp)
+	default:
+		fmt.Fprintf(w, "%s\n", vp)
+	}
+}
+
+func lsCommand(stdout io.Writer, stderr io.Writer, args []string, cp *capsulePolicy) int {
+	flags, paths, err := builtinFlags(args, "lg")
+	if err != nil {
+		fmt.Fprintf(stderr, "ls: %s\n", err)
+		return 2
+	}
+	if len(paths) == 0 {
+		paths = []string{cp.resolve("/")}
+	}
+
+	status := 0
+	for _, p := range paths {
+		vp := cp.virtualPath(p)
+
+		info, err := cp.stat(p)
+		if err != nil {
+			fmt.Fprintf(stderr, "ls: %s: No such file or directory\n", vp)
+			status = 1
+			continue
+		}
+
+		if !info.IsDir() {
+			lsEntry(stdout, info, vp, flags['l'], flags['g'])
+			continue
+		}
+
+		if flags['g'] {
+			fmt.Fprintf(stdout, "# %s\n\n", vp)
+		}
+
+		// The entries are sorted by name so the output is always the same
+		entries, err := cp.readDir(p)
+		if err != nil {
+			fmt.Fprintf(stderr, "ls: %s: Permission denied\n", vp)
+			status = 1
+			continue
+		}
+		for _, e := range entries {
+			lsEntry(stdout, e, path.Join(vp, e.Name()), flags['l'], flags['g'])
+		}
+	}
+
+	return status
+}
+
+func catCommand(stdout io.Writer, stderr io.Writer, args []string, cp *capsulePolicy) int {
+	_, paths, err := builtinFlags(args, "")
+	if err != nil {
+		fmt.Fprintf(stderr, "cat: %s\n", err)
+		return 2
+	}
+
+	status := 0
+	for _, p := range paths {
+		vp := cp.virtualPath(p)
+
+		f, err := cp.openFile(p, os.O_RDONLY, 0)
+		if err != nil {
+			fmt.Fprintf(stderr, "cat: %s: No such file or directory\n", vp)
+			status = 1
+			continue
+		}
+
+		if info, err := f.Stat(); err != nil || info.IsDir() {
+			fmt.Fprintf(stderr, "cat: %s: Is a directory\n", vp)
+			f.Close()
+			status = 1
+			continue
+		}
+
+		_, err = io.Copy(stdout, f)
+		f.Close()
+		if err != nil {
+			return 1
+		}
+	}
+
+	return status
+}
+
+func wcCommand(stdout io.Writer, stderr io.Writer, args []string, cp *capsulePolicy) int {
+	flags, paths, err := builtinFlags(args, "lwc")
+	if err != nil {
+		fmt.Fprintf(stderr, "wc: %s\n", err)
+		return 2
+	}
+	if len(flags) == 0 {
+		flags = map[rune]bool{'l': true, 'w': true, 'c': true}
+	}
+
+	status := 0
+	for _, p := range paths {
+		vp := cp.virtualPath(p)
+
+		f, err := cp.openFile(p, os.O_RDONLY, 0)
+		if err != nil {
+			fmt.Fprintf(stderr, "wc: %s: No such file or directory\n", vp)
+			status = 1
+			continue
+		}
+
+		if info, err := f.Stat(); err != nil || info.IsDir() {
+			fmt.Fprintf(stderr, "wc: %s: Is a directory\n", vp)
+			f.Close()
+			status = 1
+			continue
+		}
+
+		var lines, words, bytes int64
+		inWord := false
+		r := bufio.NewReader(f)
+		for {
+			c, size, err := r.ReadRune()
+			if err != nil {
+				break
+			}
+			bytes += int64(size)
+			if c == '\n' {
+				lines++
+			}
+			if unicode.IsSpace(c) {
+				inWord = false
+			} else if !inWord {
+				inWord = true
+				words++
+			}
+		}
+		f.Close()
+
+		counts := []string{}
+		if flags['l'] {
+			counts = append(counts, fmt.Sprint(lines))
+		}
+		if flags['w'] {
+			counts = append(counts, fmt.Sprint(words))
+		}
+		if flags['c'] {
+			counts = append(counts, fmt.Sprint(bytes))
+		}
+		fmt.Fprintf(stdout, "%s %s\n", strings.Join(counts, " "), vp)
+	}
+
+	return status
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func builtinTree(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "builtins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"my file.gmi":  "one two\nthree\n",
+		"a.txt":        "hello\n",
+		"sub/100%.gmi": "",
+	}
+	for f, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestBuiltins(t *testing.T) {
+	dir := builtinTree(t)
+	defer os.RemoveAll(dir)
+	cp := testCapsule(t, dir)
+	p := func(vp string) string {
+		return filepath.Join(dir, vp)
+	}
+
+	tests := []struct {
+		cmd    func(stdout, stderr *bytes.Buffer) int
+		status int
+		stdout string
+	}{
+		{func(o, e *bytes.Buffer) int { return lsCommand(o, e, nil, cp) }, 0,
+			"/a.txt\n/my file.gmi\n/sub/\n"},
+		{func(o, e *bytes.Buffer) int { return lsCommand(o, e, []string{"-g"}, cp) }, 0,
+			"# /\n\n=> /a.txt a.txt\n=> /my%20file.gmi my file.gmi\n=> /sub/ sub/\n"},
+		{func(o, e *bytes.Buffer) int { return lsCommand(o, e, []string{"-g", p("sub")}, cp) }, 0,
+			"# /sub\n\n=> /sub/100%25.gmi 100%.gmi\n"},
+		{func(o, e *bytes.Buffer) int { return lsCommand(o, e, []string{p("missing")}, cp) }, 1, ""},
+		{func(o, e *bytes.Buffer) int { return lsCommand(o, e, []string{"-x"}, cp) }, 2, ""},
+		{func(o, e *bytes.Buffer) int { return catCommand(o, e, []string{p("a.txt"), p("a.txt")}, cp) }, 0,
+			"hello\nhello\n"},
+		{func(o, e *bytes.Buffer) int { return catCommand(o, e, []string{p("sub"), p("a.txt")}, cp) }, 1,
+			"hello\n"},
+		{func(o, e *bytes.Buffer) int { return wcCommand(o, e, []string{p("my file.gmi")}, cp) }, 0,
+			"2 3 14 /my file.gmi\n"},
+		{func(o, e *bytes.Buffer) int { return wcCommand(o, e, []string{"-l", p("a.txt"), p("missing")}, cp) }, 1,
+			"1 /a.txt\n"},
+	}
+
+	for i, tt := range tests {
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		status := tt.cmd(stdout, stderr)
+		if status != tt.status || stdout.String() != tt.stdout {
+			t.Errorf("%d: got %d, %q (%q), want %d, %q", i, status, stdout, stderr, tt.status, tt.stdout)
+		}
+	}
+}
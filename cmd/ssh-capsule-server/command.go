@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Command templates are a list of space separated arguments. Each argument
+// is either a literal that must match exactly or a placeholder that can
+// match a range of values provided by the client:
+//
+//   <path>         a virtual path relative to the capsule content
+//   <home-path>    a ~/path in the visitor's account home directory
+//   <home>         the visitor's account home directory, taking no argument
+//   <int>          a decimal integer without a sign
+//   <word>         letters, digits, '_', '.' and '-' not starting with '-'
+//   <flags>        a run of short option letters (eg. -<flags> for -avz)
+//   <enum:a|b|c>   exactly one of the listed values
+//   <regex:...>    a value that fully matches the regular expression
+//
+// Placeholders can have a literal prefix or suffix (eg. --depth=<int>).
+// Arguments wrapped in [...] are optional and the final argument may be
+// followed by ... to match it one or more times (eg. cat <path>...).
+// Options for running the command, such as @runtime=10m, can come first.
+
+type argKind int
+
+const (
+	argLiteral argKind = iota
+	argPath
+	argHome
+	argHomePath
+	argInt
+	argWord
+	argFlags
+	argEnum
+	argRegex
+	argOptional
+)
+
+var (
+	INT_REGEX   = regexp.MustCompile("^[0-9]+$")
+	WORD_REGEX  = regexp.MustCompile("^[a-zA-Z0-9_][a-zA-Z0-9_\\.\\-]*$")
+	FLAGS_REGEX = regexp.MustCompile("^[a-zA-Z0-9\\.]+$")
+)
+
+type templateArg struct {
+	kind     argKind
+	literal  string
+	prefix   string
+	suffix   string
+	enum     []string
+	re       *regexp.Regexp
+	variadic bool
+	optional []*templateArg
+}
+
+type commandTemplate struct {
+	line     string
+	file     string
+	args     []*templateArg
+	usesHome bool
+	limits   processLimits
+}
+
+func parseTemplateArg(tok string) (*templateArg, error) {
+	i := strings.Index(tok, "<")
+	j := strings.LastIndex(tok, ">")
+	if i == -1 || j < i {
+		return &templateArg{kind: argLiteral, literal: tok}, nil
+	}
+
+	a := &templateArg{prefix: tok[:i], suffix: tok[j+1:]}
+	spec := tok[i+1 : j]
+
+	switch {
+	case spec == "path":
+		a.kind = argPath
+	case spec == "home":
+		a.kind = argHome
+	case spec == "home-path":
+		a.kind = argHomePath
+	case spec == "int":
+		a.kind = argInt
+	case spec == "word":
+		a.kind = argWord
+	case spec == "flags":
+		a.kind = argFlags
+	case strings.HasPrefix(spec, "enum:"):
+		a.kind = argEnum
+		a.enum = strings.Split(spec[5:], "|")
+	case strings.HasPrefix(spec, "regex:"):
+		re, err := regexp.Compile("^(?:" + spec[6:] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex in %q: %s", tok, err)
+		}
+		a.kind = argRegex
+		a.re = re
+	default:
+		return nil, fmt.Errorf("unknown placeholder %q", tok)
+	}
+
+	return a, nil
+}
+
+func parseCommandTemplate(line string) (*commandTemplate, error) {
+	tokens := strings.Fields(line)
+
+	limits := unsetLimits
+	for len(tokens) > 0 && strings.HasPrefix(tokens[0], "@") {
+		if err := parseTemplateOption(tokens[0], &limits); err != nil {
+			return nil, err
+		}
+		tokens = tokens[1:]
+	}
+
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty command template")
+	}
+
+	// Arguments are collected into a stack of groups, with
+	//  each [ opening a new optional group.
+	stack := [][]*templateArg{nil}
+	for ti, tok := range tokens {
+		for strings.HasPrefix(tok, "[") {
+			tok = tok[1:]
+			stack = append(stack, nil)
+		}
+
+		// Trailing ] close groups, but only after any placeholder
+		//  since a regex may contain them.
+		closes := 0
+		limit := strings.LastIndex(tok, ">") + 1
+		for len(tok) > limit && strings.HasSuffix(tok, "]") {
+			tok = tok[:len(tok)-1]
+			closes++
+		}
+
+		variadic := false
+		if strings.HasSuffix(tok, "...") && strings.Contains(tok, ">") {
+			if ti != len(tokens)-1 {
+				return nil, fmt.Errorf("only the last argument can repeat: %q", tok)
+			}
+			tok = tok[:len(tok)-3]
+			variadic = true
+		}
+
+		if tok != "" {
+			a, err := parseTemplateArg(tok)
+			if err != nil {
+				return nil, err
+			}
+			if variadic && a.kind == argHome {
+				return nil, fmt.Errorf("<home> can't repeat in %q", line)
+			}
+			a.variadic = variadic
+			stack[len(stack)-1] = append(stack[len(stack)-1], a)
+		}
+
+		for ; closes > 0; closes-- {
+			if len(stack) == 1 {
+				return nil, fmt.Errorf("unbalanced ] in %q", line)
+			}
+			group := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if len(group) == 0 {
+				return nil, fmt.Errorf("empty optional group in %q", line)
+			}
+			stack[len(stack)-1] = append(stack[len(stack)-1], &templateArg{kind: argOptional, optional: group})
+		}
+	}
+
+	if len(stack) != 1 {
+		return nil, fmt.Errorf("unbalanced [ in %q", line)
+	}
+
+	args := stack[0]
+	if args[0].kind != argLiteral {
+		return nil, fmt.Errorf("command name must be a literal in %q", line)
+	}
+
+	return &commandTemplate{line: line, args: args, usesHome: usesHome(args), limits: limits}, nil
+}
+
+func usesHome(args []*templateArg) bool {
+	for _, a := range args {
+		if a.kind == argHome || a.kind == argHomePath || usesHome(a.optional) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolves the value of a path placeholder into a physical path, or an
+// empty string if it isn't permitted.
+type pathResolver func(kind argKind, p string) string
+
+func (a *templateArg) match(arg string, resolvePath pathResolver) (string, bool) {
+	if a.kind == argLiteral {
+		return arg, arg == a.literal
+	}
+
+	if !strings.HasPrefix(arg, a.prefix) || !strings.HasSuffix(arg, a.suffix) || len(arg) < len(a.prefix)+len(a.suffix) {
+		return "", false
+	}
+	v := arg[len(a.prefix) : len(arg)-len(a.suffix)]
+
+	switch a.kind {
+	case argPath, argHomePath:
+		// Special handling for paths
+		if !validPath(v) {
+			return "", false
+		}
+		v = resolvePath(a.kind, v)
+		if v == "" {
+			return "", false
+		}
+	case argInt:
+		if !INT_REGEX.MatchString(v) {
+			return "", false
+		}
+	case argWord:
+		if !WORD_REGEX.MatchString(v) {
+			return "", false
+		}
+	case argFlags:
+		if !FLAGS_REGEX.MatchString(v) {
+			return "", false
+		}
+	case argEnum:
+		found := false
+		for _, e := range a.enum {
+			if v == e {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", false
+		}
+	case argRegex:
+		if !a.re.MatchString(v) {
+			return "", false
+		}
+	default:
+		return "", false
+	}
+
+	return a.prefix + v + a.suffix, true
+}
+
+func matchArgs(args []*templateArg, cmd []string, resolvePath pathResolver) ([]string, bool) {
+	if len(args) == 0 {
+		return []string{}, len(cmd) == 0
+	}
+
+	a := args[0]
+
+	if a.kind == argOptional {
+		// Try with the optional arguments present first and then without
+		withGroup := append(append([]*templateArg{}, a.optional...), args[1:]...)
+		if m, ok := matchArgs(withGroup, cmd, resolvePath); ok {
+			return m, true
+		}
+		return matchArgs(args[1:], cmd, resolvePath)
+	}
+
+	// The home directory is supplied by the server, not the client
+	if a.kind == argHome {
+		home := resolvePath(argHome, "")
+		if home == "" {
+			return nil, false
+		}
+		rest, ok := matchArgs(args[1:], cmd, resolvePath)
+		if !ok {
+			return nil, false
+		}
+		return append([]string{a.prefix + home + a.suffix}, rest...), true
+	}
+
+	if a.variadic {
+		if len(cmd) == 0 {
+			return nil, false
+		}
+		matched := []string{}
+		for _, c := range cmd {
+			m, ok := a.match(c, resolvePath)
+			if !ok {
+				return nil, false
+			}
+			matched = append(matched, m)
+		}
+		return matched, true
+	}
+
+	if len(cmd) == 0 {
+		return nil, false
+	}
+
+	m, ok := a.match(cmd[0], resolvePath)
+	if !ok {
+		return nil, false
+	}
+
+	rest, ok := matchArgs(args[1:], cmd[1:], resolvePath)
+	if !ok {
+		return nil, false
+	}
+
+	return append([]string{m}, rest...), true
+}
+
+// Match the client's command against this template, returning the command
+// to run with any paths resolved or nil if it doesn't match.
+func (t *commandTemplate) match(cmd []string, resolvePath pathResolver) []string {
+	// No command is provided and this is the default, a template
+	//  with only the command name.
+	if len(cmd) == 0 {
+		if len(t.args) != 1 {
+			return nil
+		}
+		return []string{t.args[0].literal}
+	}
+
+	m, ok := matchArgs(t.args, cmd, resolvePath)
+	if !ok || len(m) == 0 {
+		return nil
+	}
+
+	return m
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCommandTemplate(t *testing.T) {
+	tests := []struct {
+		line string
+		ok   bool
+	}{
+		{"tpl", true},
+		{"ls [-l] [-g] [<path>]", true},
+		{"ls [-l [-a]] <path>...", true},
+		{"git clone --depth=<int> <path>", true},
+		{"grep <regex:[a-z]+> <path>", true},
+		{"log <enum:short|full>", true},
+		{"", false},
+		{"<path>", false},
+		{"ls <bogus>", false},
+		{"grep <regex:(>", false},
+		{"ls [<path>", false},
+		{"ls <path>]", false},
+		{"ls []", false},
+		{"cat <path>... -n", false},
+		{"tar <home>...", false},
+	}
+
+	for _, tt := range tests {
+		_, err := parseCommandTemplate(tt.line)
+		if tt.ok && err != nil {
+			t.Errorf("parseCommandTemplate(%q) failed: %s", tt.line, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("parseCommandTemplate(%q) succeeded, want an error", tt.line)
+		}
+	}
+}
+
+// Paths are resolved below /c, the home is /h and "secret" isn't permitted
+func testResolver(kind argKind, p string) string {
+	switch kind {
+	case argHome:
+		return "/h"
+	case argHomePath:
+		if !strings.HasPrefix(p, "~/") {
+			return ""
+		}
+		return "/h/" + p[2:]
+	}
+	if strings.TrimPrefix(p, "/") == "secret" {
+		return ""
+	}
+	return "/c/" + strings.TrimPrefix(p, "/")
+}
+
+func TestTemplateMatch(t *testing.T) {
+	tests := []struct {
+		line string
+		cmd  string
+		want string
+	}{
+		// Only a template with just the command name is the default
+		{"tpl", "", "tpl"},
+		{"ls [<path>]", "", ""},
+		{"tar <home>", "", ""},
+
+		{"tpl", "tpl", "tpl"},
+		{"tpl", "tpl x", ""},
+		{"tpl", "other", ""},
+		{"ls [<path>]", "ls", "ls"},
+		{"ls [<path>]", "ls a", "ls /c/a"},
+		{"ls [-l] [<path>]", "ls -l a", "ls -l /c/a"},
+		{"ls [-l] [<path>]", "ls a -l", ""},
+		{"ls [-l [-a]]", "ls -l -a", "ls -l -a"},
+		{"ls [-l [-a]]", "ls -a", ""},
+		{"cat <path>", "cat /a/b", "cat /c/a/b"},
+		{"cat <path>", "cat secret", ""},
+		{"cat <path>", "cat", ""},
+		{"cat <path>", "cat día.gmi", "cat /c/día.gmi"},
+		{"cat <path>", "cat --help", ""},
+		{"cat <path>...", "cat a b", "cat /c/a /c/b"},
+		{"cat <path>...", "cat a secret", ""},
+		{"cat <path>...", "cat", ""},
+		{"head -n <int> <path>", "head -n 5 a", "head -n 5 /c/a"},
+		{"head -n <int> <path>", "head -n -5 a", ""},
+		{"head -n <int> <path>", "head -n +5 a", ""},
+		{"git --depth=<int>", "git --depth=3", "git --depth=3"},
+		{"git --depth=<int>", "git --depth=x", ""},
+		{"git --depth=<int>", "git --depth=", ""},
+		{"seek <regex:-?[0-9]+>", "seek -5", "seek -5"},
+		{"redeem <word>", "redeem abc.1", "redeem abc.1"},
+		{"redeem <word>", "redeem -x", ""},
+		{"rsync -<flags>", "rsync -avz", "rsync -avz"},
+		{"rsync -<flags>", "rsync -a;z", ""},
+		{"log <enum:short|full>", "log full", "log full"},
+		{"log <enum:short|full>", "log other", ""},
+		{"show <regex:v[0-9]+>", "show v12", "show v12"},
+		{"show <regex:v[0-9]+>", "show v12x", ""},
+		{"tar <home> [<path>]", "tar", "tar /h"},
+		{"tar <home> [<path>]", "tar a", "tar /h /c/a"},
+		{"put <home-path>", "put ~/f", "put /h/f"},
+		{"put <home-path>", "put f", ""},
+	}
+
+	for _, tt := range tests {
+		ct, err := parseCommandTemplate(tt.line)
+		if err != nil {
+			t.Fatalf("parseCommandTemplate(%q) failed: %s", tt.line, err)
+		}
+		got := ct.match(strings.Fields(tt.cmd), testResolver)
+		var want []string
+		if tt.want != "" {
+			want = strings.Fields(tt.want)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q matching %q = %q, want %q", tt.line, tt.cmd, got, want)
+		}
+	}
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The server can be configured with a single JSON file instead of the
+// capsule directories. The first capsule is the default capsule. A capsule
+// with only a path is loaded from its directory the same way as the
+// --capsule option.
+//
+// {
+//   "listen_addresses": [":1966", "unix:/run/ssh-capsule-server.sock"],
+//   "idle_timeout": "10s",
+//   "host_key": "/srv/hostkey",
+//   "host_keys": ["/srv/hostkey_rsa"],
+//   "max_runtime": "10m",
+//   "max_output": "1G",
+//   "max_stdin": "100M",
+//   "sandbox": true,
+//   "sandbox_paths": ["/usr", "/lib", "/lib64", "/etc/ssl"],
+//   "audit_log": "/var/log/ssh-capsule-server/audit.log",
+//   "metrics_address": "127.0.0.1:9166",
+//   "proxy_trusted": ["10.0.0.0/8"],
+//   "frontend_keys": ["ssh-ed25519 AAAA..."],
+//   "shutdown_grace": "30s",
+//   "rate_limits": {
+//     "key_connections": "20/1m",
+//     "key_commands": "60/1m",
+//     "address_connections": "60/1m",
+//     "address_commands": "120/1m",
+//     "max_key_sessions": 4,
+//     "ipv6_prefix": 64,
+//     "exempt": ["127.0.0.0/8", "::1"]
+//   },
+//   "capsules": [
+//     {
+//       "name": "example",
+//       "hosts": ["example.com"],
+//       "content": "/var/srv/example",
+//       "mounts": [
+//         { "path": "/downloads", "source": "/mnt/big", "read_only": true }
+//       ],
+//       "trusted_links": ["/usr/share/doc"],
+//       "bin": "/var/srv/example-bin",
+//       "homes": "/var/lib/example-homes",
+//       "quota": {
+//         "account": { "bytes": "10M", "files": 1000 },
+//         "capsule": { "bytes": "1G" }
+//       },
+//       "user": { "name": "example" },
+//       "access": {
+//         "deny": ["SHA256:mVPwvezndPv/ARoIadVY98vAC0g+P/5633yTC4d/Nx0", "203.0.113.0/24"],
+//         "message": "61 access denied: write to abuse@example.com"
+//       },
+//       "commands": ["tpl", "cat <path>"],
+//       "groups": {
+//         "editor": {
+//           "keys": ["ssh-ed25519 AAAA...", "expires=\"2027-01-01\" SHA256:mVPwvezndPv/ARoIadVY98vAC0g+P/5633yTC4d/Nx0"],
+//           "commands": ["sftp -w /", "git-receive-pack <path>"],
+//           "user": { "name": "example-editor", "group": "example", "groups": ["git"] },
+//           "access": { "allow": ["192.0.2.0/24"] }
+//         }
+//       }
+//     },
+//     { "path": "/srv/othercapsule" },
+//     {
+//       "name": "split-off",
+//       "hosts": ["split.example.com"],
+//       "backend": {
+//         "address": "backend.example.com:1966",
+//         "host_key": "ssh-ed25519 AAAA..."
+//       }
+//     }
+//   ]
+// }
+
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+type userConfig struct {
+	Name   string   `json:"name"`
+	Group  string   `json:"group"`
+	Groups []string `json:"groups"`
+}
+
+type backendConfig struct {
+	Address  string `json:"address"`
+	HostKey  string `json:"host_key"`
+	Identity string `json:"identity"`
+}
+
+type accessConfig struct {
+	Deny    []string `json:"deny"`
+	Allow   []string `json:"allow"`
+	Message string   `json:"message"`
+}
+
+type groupConfig struct {
+	Keys     []string      `json:"keys"`
+	Commands []string      `json:"commands"`
+	Implies  []string      `json:"implies"`
+	User     *userConfig   `json:"user"`
+	Access   *accessConfig `json:"access"`
+}
+
+type quotaConfig struct {
+	Bytes string `json:"bytes"`
+	Files int64  `json:"files"`
+}
+
+type quotasConfig struct {
+	Account *quotaConfig `json:"account"`
+	Capsule *quotaConfig `json:"capsule"`
+}
+
+type mountConfig struct {
+	Path     string `json:"path"`
+	Source   string `json:"source"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+type capsuleConfig struct {
+	Name     string                 `json:"name"`
+	Path     string                 `json:"path"`
+	Hosts    []string               `json:"hosts"`
+	Content  string                 `json:"content"`
+	Mounts   []mountConfig          `json:"mounts"`
+	Trusted  []string               `json:"trusted_links"`
+	Bin      string                 `json:"bin"`
+	Homes    string                 `json:"homes"`
+	Quota    *quotasConfig          `json:"quota"`
+	User     *userConfig            `json:"user"`
+	Backend  *backendConfig         `json:"backend"`
+	Access   *accessConfig          `json:"access"`
+	Commands []string               `json:"commands"`
+	Groups   map[string]groupConfig `json:"groups"`
+}
+
+type serverConfig struct {
+	ListenAddress   string           `json:"listen_address"`
+	ListenAddresses []string         `json:"listen_addresses"`
+	IdleTimeout     duration         `json:"idle_timeout"`
+	ReloadInterval  *duration        `json:"reload_interval"`
+	HostKey         string           `json:"host_key"`
+	HostKeys        []string         `json:"host_keys"`
+	HostKeyType     string           `json:"host_key_type"`
+	RateLimits      *rateLimitConfig `json:"rate_limits"`
+	MaxRuntime      *duration        `json:"max_runtime"`
+	MaxOutput       string           `json:"max_output"`
+	MaxStdin        string           `json:"max_stdin"`
+	Sandbox         bool             `json:"sandbox"`
+	SandboxPaths    []string         `json:"sandbox_paths"`
+	AuditLog        string           `json:"audit_log"`
+	MetricsAddress  string           `json:"metrics_address"`
+	ProxyTrusted    []string         `json:"proxy_trusted"`
+	FrontendKeys    []string         `json:"frontend_keys"`
+	ShutdownGrace   *duration        `json:"shutdown_grace"`
+	Capsules        []capsuleConfig  `json:"capsules"`
+}
+
+func readConfig(configFile string) (*serverConfig, error) {
+	f, err := os.Open(configFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := &serverConfig{}
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	if err := d.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %s", configFile, err)
+	}
+
+	if len(cfg.Capsules) == 0 {
+		return nil, fmt.Errorf("%s: no capsules are configured", configFile)
+	}
+
+	// Relative paths are relative to the configuration file
+	dir := filepath.Dir(configFile)
+	abs := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	cfg.HostKey = abs(cfg.HostKey)
+	for i := range cfg.HostKeys {
+		cfg.HostKeys[i] = abs(cfg.HostKeys[i])
+	}
+	cfg.AuditLog = abs(cfg.AuditLog)
+	for i := range cfg.Capsules {
+		c := &cfg.Capsules[i]
+		c.Path = abs(c.Path)
+		c.Content = abs(c.Content)
+		c.Bin = abs(c.Bin)
+		c.Homes = abs(c.Homes)
+		if c.Backend != nil {
+			c.Backend.Identity = abs(c.Backend.Identity)
+		}
+		for j := range c.Mounts {
+			c.Mounts[j].Source = abs(c.Mounts[j].Source)
+		}
+		for j := range c.Trusted {
+			c.Trusted[j] = abs(c.Trusted[j])
+		}
+	}
+
+	return cfg, nil
+}
+
+func configMounts(mcs []mountConfig) []mount {
+	mounts := []mount{}
+	for _, mc := range mcs {
+		mounts = append(mounts, mount{
+			virtual:  cleanVirtualPath(mc.Path),
+			physical: filepath.Clean(mc.Source),
+			readOnly: mc.ReadOnly,
+		})
+	}
+	return mounts
+}
+
+func configQuota(qc *quotaConfig) (quota, error) {
+	q := quota{}
+	if qc == nil {
+		return q, nil
+	}
+	if qc.Bytes != "" {
+		b, err := parseSize(qc.Bytes)
+		if err != nil {
+			return q, err
+		}
+		q.bytes = b
+	}
+	if qc.Files < 0 {
+		return q, fmt.Errorf("invalid file count %d", qc.Files)
+	}
+	q.files = qc.Files
+	return q, nil
+}
+
+func configCredential(uc *userConfig) (*credential, error) {
+	if uc == nil {
+		return nil, nil
+	}
+	spec := uc.Name
+	if uc.Group != "" {
+		spec += ":" + uc.Group
+	}
+	return lookupCredential(spec, uc.Groups)
+}
+
+func configAccess(ac *accessConfig) (*accessList, error) {
+	al := newAccessList()
+	for _, r := range ac.Deny {
+		if err := al.add("deny", r); err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range ac.Allow {
+		if err := al.add("allow", r); err != nil {
+			return nil, err
+		}
+	}
+	return al, nil
+}
+
+// Set the capsule's access lists from the configuration
+func (cp *capsulePolicy) setAccess(ac *accessConfig) error {
+	var err error
+	if cp.access, err = configAccess(ac); err != nil {
+		return fmt.Errorf("capsule %q: access: %s", cp.name, err)
+	}
+	cp.accessDenied = ac.Message
+	return nil
+}
+
+// Set the capsule's quotas from the configuration
+func (cp *capsulePolicy) setQuota(qc *quotasConfig) error {
+	var err error
+	if cp.accountQuota, err = configQuota(qc.Account); err != nil {
+		return fmt.Errorf("capsule %q: account quota: %s", cp.name, err)
+	}
+	if cp.capsuleQuota, err = configQuota(qc.Capsule); err != nil {
+		return fmt.Errorf("capsule %q: capsule quota: %s", cp.name, err)
+	}
+	return nil
+}
+
+func configCapsulePolicy(c capsuleConfig) (*capsulePolicy, error) {
+	name := c.Name
+	if name == "" {
+		name = c.Path
+	}
+
+	cp := &capsulePolicy{
+		name:     name,
+		path:     c.Path,
+		hosts:    []string{},
+		content:  c.Content,
+		bin:      c.Bin,
+		homes:    c.Homes,
+		commands: map[string][]*commandTemplate{},
+
+		trustedLinks:  c.Trusted,
+		groups:        map[string][]*groupEntry{},
+		impliedGroups: map[string][]string{},
+		groupUsers:    map[string]*credential{},
+		groupAccess:   map[string]*accessList{},
+	}
+
+	if cp.content == "" && c.Path != "" {
+		cp.content = filepath.Join(c.Path, "content")
+	}
+	if cp.bin == "" && c.Path != "" {
+		cp.bin = filepath.Join(c.Path, "bin")
+	}
+	if cp.homes == "" && c.Path != "" {
+		cp.homes = filepath.Join(c.Path, "homes")
+	}
+	if c.Backend != nil {
+		b, err := newBackend(c.Backend.Address, c.Backend.HostKey, c.Backend.Identity)
+		if err != nil {
+			return nil, fmt.Errorf("capsule %q: %s", name, err)
+		}
+		cp.backend = b
+	} else if cp.content == "" {
+		return nil, fmt.Errorf("capsule %q: content or path is required", name)
+	}
+	if err := cp.setMounts(configMounts(c.Mounts)); err != nil {
+		return nil, fmt.Errorf("capsule %q: %s", name, err)
+	}
+	if c.Quota != nil {
+		if err := cp.setQuota(c.Quota); err != nil {
+			return nil, err
+		}
+	}
+	if c.Access != nil {
+		if err := cp.setAccess(c.Access); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, h := range c.Hosts {
+		if h != "" {
+			cp.hosts = append(cp.hosts, h)
+		}
+	}
+
+	parse := func(cf string, lines []string) error {
+		templates := []*commandTemplate{}
+		for _, l := range lines {
+			cmdTemplate, err := parseCommandTemplate(l)
+			if err != nil {
+				return fmt.Errorf("capsule %q: %s: %s", name, cf, err)
+			}
+			cmdTemplate.file = cf
+			templates = append(templates, cmdTemplate)
+		}
+		cp.commands[cf] = templates
+		return nil
+	}
+
+	var err error
+	if cp.user, err = configCredential(c.User); err != nil {
+		return nil, fmt.Errorf("capsule %q: user: %s", name, err)
+	}
+
+	if err := parse("commands", c.Commands); err != nil {
+		return nil, err
+	}
+	for g, gc := range c.Groups {
+		if err := parse("commands-"+g, gc.Commands); err != nil {
+			return nil, err
+		}
+		if gc.User != nil {
+			if cp.groupUsers[g], err = configCredential(gc.User); err != nil {
+				return nil, fmt.Errorf("capsule %q: group %s: user: %s", name, g, err)
+			}
+		}
+		if gc.Access != nil {
+			if gc.Access.Message != "" {
+				return nil, fmt.Errorf("capsule %q: group %s: access: the message is only for the capsule", name, g)
+			}
+			if cp.groupAccess[g], err = configAccess(gc.Access); err != nil {
+				return nil, fmt.Errorf("capsule %q: group %s: access: %s", name, g, err)
+			}
+		}
+		for _, k := range gc.Keys {
+			account, e, err := parseGroupEntry(k)
+			if err != nil {
+				return nil, fmt.Errorf("capsule %q: group %s: %s", name, g, err)
+			}
+			e.groups = []string{g}
+			e.line += " (" + g + ")"
+			cp.groups[account] = append(cp.groups[account], e)
+		}
+		if len(gc.Implies) > 0 {
+			cp.impliedGroups[g] = gc.Implies
+		}
+	}
+
+	return cp, nil
+}
+
+func loadConfigPolicy(configFile string) (*policy, error) {
+	cfg, err := readConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &policy{files: []string{configFile}}
+
+	for _, c := range cfg.Capsules {
+		// The directory layout is used when the capsule isn't described here
+		if c.Path != "" && c.Commands == nil && c.Groups == nil {
+			cp, files, err := loadCapsulePolicy(c.Path)
+			if err != nil {
+				return nil, err
+			}
+			if c.Name != "" {
+				cp.name = c.Name
+			}
+			if len(c.Hosts) > 0 {
+				cp.hosts = c.Hosts
+			}
+			if c.Content != "" || c.Mounts != nil {
+				if c.Content != "" {
+					cp.content = c.Content
+				}
+				if err := cp.setMounts(configMounts(c.Mounts)); err != nil {
+					return nil, fmt.Errorf("%s: capsule %q: %s", configFile, cp.name, err)
+				}
+			}
+			if c.Bin != "" {
+				cp.bin = c.Bin
+			}
+			if c.Homes != "" {
+				cp.homes = c.Homes
+			}
+			if c.Quota != nil {
+				if err := cp.setQuota(c.Quota); err != nil {
+					return nil, fmt.Errorf("%s: %s", configFile, err)
+				}
+			}
+			if c.Trusted != nil {
+				cp.trustedLinks = c.Trusted
+			}
+			if c.Backend != nil {
+				if cp.backend, err = newBackend(c.Backend.Address, c.Backend.HostKey, c.Backend.Identity); err != nil {
+					return nil, fmt.Errorf("%s: capsule %q: %s", configFile, cp.name, err)
+				}
+			}
+			if c.User != nil {
+				if cp.user, err = configCredential(c.User); err != nil {
+					return nil, fmt.Errorf("%s: capsule %q: user: %s", configFile, cp.name, err)
+				}
+			}
+			if c.Access != nil {
+				if err := cp.setAccess(c.Access); err != nil {
+					return nil, fmt.Errorf("%s: %s", configFile, err)
+				}
+			}
+			p.capsules = append(p.capsules, cp)
+			p.files = append(p.files, files...)
+			continue
+		}
+
+		cp, err := configCapsulePolicy(c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", configFile, err)
+		}
+		p.capsules = append(p.capsules, cp)
+	}
+
+	p.signature = policySignature(p.files)
+	return p, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	gossh "golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{`{"capsules": [{"path": "a"}]}`, ""},
+		{`{"capsules": []}`, "no capsules"},
+		{`{"capsules": [{"path": "a"}], "bogus": 1}`, "unknown field"},
+		{`{"idle_timeout": "soon", "capsules": [{"path": "a"}]}`, "invalid duration"},
+		{`{"capsules": [{"path": "a"}]`, "unexpected EOF"},
+	}
+
+	cf := filepath.Join(dir, "config.json")
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(cf, []byte(tt.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := readConfig(cf)
+		if tt.err == "" && err != nil {
+			t.Errorf("%s failed: %s", tt.config, err)
+		} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s gave %v, want an error with %q", tt.config, err, tt.err)
+		}
+	}
+
+	config := `{
+  "idle_timeout": "30s",
+  "reload_interval": "0s",
+  "host_key": "hostkey",
+  "capsules": [
+    {"path": "a", "bin": "/usr/local/capsule-bin"},
+    {"name": "b", "content": "b/content"}
+  ]
+}`
+	if err := ioutil.WriteFile(cf, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := readConfig(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.IdleTimeout.Duration != 30*time.Second {
+		t.Errorf("idle_timeout = %s", cfg.IdleTimeout.Duration)
+	}
+	if cfg.ReloadInterval == nil || cfg.ReloadInterval.Duration != 0 {
+		t.Errorf("reload_interval = %v, want 0s", cfg.ReloadInterval)
+	}
+	// Relative paths are relative to the configuration file
+	if cfg.HostKey != filepath.Join(dir, "hostkey") {
+		t.Errorf("host_key = %s", cfg.HostKey)
+	}
+	if c := cfg.Capsules[0]; c.Path != filepath.Join(dir, "a") || c.Bin != "/usr/local/capsule-bin" {
+		t.Errorf("capsule a has path %s and bin %s", c.Path, c.Bin)
+	}
+	if c := cfg.Capsules[1]; c.Path != "" || c.Content != filepath.Join(dir, "b/content") {
+		t.Errorf("capsule b has path %q and content %s", c.Path, c.Content)
+	}
+}
+
+func TestConfigCapsulePolicy(t *testing.T) {
+	editor := testKey(t)
+	c := capsuleConfig{
+		Name:     "example",
+		Hosts:    []string{"example.com", ""},
+		Content:  "/srv/example",
+		Commands: []string{"tpl", "cat <path>"},
+		Groups: map[string]groupConfig{
+			"editor": {
+				Keys:     []string{string(gossh.MarshalAuthorizedKey(editor))},
+				Commands: []string{"sftp -w /"},
+			},
+		},
+	}
+	cp, err := configCapsulePolicy(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cp.hosts, []string{"example.com"}) || cp.content != "/srv/example" || cp.bin != "" {
+		t.Errorf("capsule has hosts %q, content %q and bin %q", cp.hosts, cp.content, cp.bin)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	if got := templateLines(cp.forClient(accountName(editor), addr).templates()); !reflect.DeepEqual(got, []string{"tpl", "cat <path>", "sftp -w /"}) {
+		t.Errorf("editor templates = %q", got)
+	}
+	if got := templateLines(cp.forClient(accountName(testKey(t)), addr).templates()); !reflect.DeepEqual(got, []string{"tpl", "cat <path>"}) {
+		t.Errorf("public templates = %q", got)
+	}
+
+	// The content and bin directories default to the ones below the path
+	cp, err = configCapsulePolicy(capsuleConfig{Path: "/srv/c", Commands: []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.name != "/srv/c" || cp.content != filepath.Join("/srv/c", "content") || cp.bin != filepath.Join("/srv/c", "bin") {
+		t.Errorf("capsule has name %q, content %q and bin %q", cp.name, cp.content, cp.bin)
+	}
+
+	if _, err := configCapsulePolicy(capsuleConfig{Name: "x", Commands: []string{"tpl"}}); err == nil {
+		t.Errorf("a capsule without content or path loaded")
+	}
+	if _, err := configCapsulePolicy(capsuleConfig{Name: "x", Content: "/c", Commands: []string{"ls <bogus>"}}); err == nil {
+		t.Errorf("a capsule with a bad template loaded")
+	}
+}
+
+func TestLoadConfigPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeCapsule(t, filepath.Join(dir, "dir"), map[string]string{
+		"host":     "dir.example.com\n",
+		"commands": "tpl\n",
+	})
+	config := `{
+  "capsules": [
+    {"name": "inline", "content": "inline", "commands": ["tpl"]},
+    {"name": "dir", "path": "dir", "hosts": ["other.example.com"]}
+  ]
+}`
+	cf := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(cf, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := loadConfigPolicy(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.capsules) != 2 {
+		t.Fatalf("%d capsules were loaded", len(p.capsules))
+	}
+	// Hosts in the configuration take the place of the host file
+	if cp := p.capsuleForHost("other.example.com"); cp.name != "dir" {
+		t.Errorf("other.example.com is served by %s", cp.name)
+	}
+	if cp := p.capsuleForHost("dir.example.com"); cp.name != "inline" {
+		t.Errorf("dir.example.com is served by %s", cp.name)
+	}
+	if p.files[0] != cf || len(p.files) < 2 {
+		t.Errorf("watching %q", p.files)
+	}
+}
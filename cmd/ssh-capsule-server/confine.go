@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Paths are resolved one component at a time so that the OS never follows a
+// symbolic link on our behalf. Each link is expanded here and its target must
+// stay inside the mount it was found in. A capsule can trust links into other
+// directories by listing them in its trusted-links file.
+//
+// The resolved path is what external commands are given. The server's own
+// file access walks the path again from the mount with directory file
+// descriptors, the way openat(2) does with O_NOFOLLOW, so that a link swapped
+// in after the path was resolved can't lead outside of the mount. Writes
+// don't follow links out of the mount at all and never through the last
+// component of the path.
+
+const MAX_SYMLINKS = 40
+
+func within(p string, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+string(filepath.Separator))
+}
+
+func splitPath(p string) []string {
+	return strings.Split(filepath.ToSlash(p), "/")
+}
+
+// The names in a path, leaving out empty ones and "."
+func components(p string) []string {
+	names := []string{}
+	for _, c := range splitPath(p) {
+		if c != "" && c != "." {
+			names = append(names, c)
+		}
+	}
+	return names
+}
+
+func realDir(p string) string {
+	if r, err := filepath.EvalSymlinks(p); err == nil {
+		return r
+	}
+	return filepath.Clean(p)
+}
+
+// Resolve the relative path rel below root following symbolic links only
+// while they stay inside root or one of the trusted directories.
+func confinePath(root string, rel string, trusted []string) (string, error) {
+	realRoot := realDir(root)
+	roots := []string{realRoot}
+	for _, t := range trusted {
+		roots = append(roots, realDir(t))
+	}
+
+	base := realRoot
+	current := ""
+	pending := splitPath(rel)
+	links := 0
+
+	for len(pending) > 0 {
+		c := pending[0]
+		pending = pending[1:]
+
+		if c == "" || c == "." {
+			continue
+		} else if c == ".." {
+			return "", fmt.Errorf("%s leaves %s", rel, root)
+		}
+
+		next := filepath.Join(base, current, c)
+		info, err := os.Lstat(next)
+		if os.IsNotExist(err) {
+			// The rest of the path doesn't exist yet, such as an upload
+			//  target, so it can't have links but it can't leave either.
+			for _, p := range pending {
+				if p == ".." {
+					return "", fmt.Errorf("%s leaves %s", rel, root)
+				}
+			}
+			return filepath.Join(append([]string{next}, pending...)...), nil
+		} else if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = filepath.Join(current, c)
+			continue
+		}
+
+		links++
+		if links > MAX_SYMLINKS {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", rel)
+		}
+
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(base, current, target)
+		}
+		target = filepath.Clean(target)
+
+		// The link target is walked again from whichever root contains it
+		found := false
+		for _, r := range roots {
+			if within(target, r) {
+				t, _ := filepath.Rel(r, target)
+				base = r
+				current = ""
+				pending = append(splitPath(t), pending...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("%s links to %s outside of %s", rel, target, root)
+		}
+	}
+
+	return filepath.Join(base, current), nil
+}
+
+// The root of the mount or trusted directory that a resolved path is in, the
+// path relative to it and the directories that links there can lead to.
+func (cp *capsulePolicy) confinedRoot(p string) (string, string, []string, error) {
+	if m := cp.mountForPhysical(p); m != nil {
+		root := m.real
+		if !within(p, root) {
+			root = m.physical
+		}
+		trusted := cp.trustedLinks
+		if m.virtual == "~" {
+			trusted = nil
+		}
+		rel, err := filepath.Rel(root, p)
+		return root, rel, trusted, err
+	}
+	for _, t := range cp.trustedLinks {
+		if r := realDir(t); within(p, r) {
+			rel, err := filepath.Rel(r, p)
+			return r, rel, cp.trustedLinks, err
+		}
+	}
+	return "", "", nil, &os.PathError{Op: "open", Path: p, Err: os.ErrPermission}
+}
+
+// Walk to the entry of a resolved path. An entry that is written to must be
+// in a writable mount once its links have been followed.
+func (cp *capsulePolicy) entry(p string, write bool) (*confinedEntry, error) {
+	root, rel, trusted, err := cp.confinedRoot(p)
+	if err != nil {
+		return nil, err
+	}
+	if write {
+		trusted = nil
+	}
+
+	e, err := walkConfined(root, rel, trusted, !write)
+	if err != nil {
+		return nil, err
+	}
+	if write && cp.readOnly(e.path()) {
+		e.close()
+		return nil, &os.PathError{Op: "write", Path: p, Err: os.ErrPermission}
+	}
+	return e, nil
+}
+
+func isWrite(flag int) bool {
+	return flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+}
+
+// Open a resolved path without following links out of its mount
+func (cp *capsulePolicy) openFile(p string, flag int, perm os.FileMode) (*os.File, error) {
+	e, err := cp.entry(p, isWrite(flag))
+	if err != nil {
+		return nil, err
+	}
+	defer e.close()
+
+	// Only a file that didn't exist yet is given to the owner
+	if cp.owner != nil && flag&os.O_CREATE != 0 {
+		f, err := e.open(flag|os.O_EXCL, perm)
+		if err == nil {
+			if err := f.Chown(int(cp.owner.uid), int(cp.owner.gid)); err != nil {
+				f.Close()
+				e.remove()
+				return nil, err
+			}
+			return f, nil
+		}
+		if flag&os.O_EXCL != 0 || !os.IsExist(err) {
+			return nil, err
+		}
+		flag &^= os.O_CREATE
+	}
+	return e.open(flag, perm)
+}
+
+func (cp *capsulePolicy) readFile(p string) ([]byte, error) {
+	f, err := cp.openFile(p, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func (cp *capsulePolicy) stat(p string) (os.FileInfo, error) {
+	f, err := cp.openFile(p, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+func (cp *capsulePolicy) mkdir(p string, perm os.FileMode) error {
+	e, err := cp.entry(p, true)
+	if err != nil {
+		return err
+	}
+	defer e.close()
+	if err := e.mkdir(perm); err != nil {
+		return err
+	}
+	if cp.owner != nil {
+		if err := e.chown(int(cp.owner.uid), int(cp.owner.gid)); err != nil {
+			e.remove()
+			return err
+		}
+	}
+	return nil
+}
+
+func (cp *capsulePolicy) remove(p string) error {
+	e, err := cp.entry(p, true)
+	if err != nil {
+		return err
+	}
+	defer e.close()
+	return e.remove()
+}
+
+func (cp *capsulePolicy) rename(p string, np string) error {
+	from, err := cp.entry(p, true)
+	if err != nil {
+		return err
+	}
+	defer from.close()
+	to, err := cp.entry(np, true)
+	if err != nil {
+		return err
+	}
+	defer to.close()
+	return renameEntry(from, to)
+}
+
+func (cp *capsulePolicy) chmod(p string, mode os.FileMode) error {
+	e, err := cp.entry(p, true)
+	if err != nil {
+		return err
+	}
+	defer e.close()
+	return e.chmod(mode)
+}
+
+func (cp *capsulePolicy) chtimes(p string, atime time.Time, mtime time.Time) error {
+	e, err := cp.entry(p, true)
+	if err != nil {
+		return err
+	}
+	defer e.close()
+	return e.chtimes(atime, mtime)
+}
+
+func (cp *capsulePolicy) truncate(p string, size int64) error {
+	f, err := cp.openFile(p, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Truncate(size)
+}
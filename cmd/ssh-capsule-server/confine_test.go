@@ -0,0 +1,217 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// A capsule with its content in dir/root, a trusted directory and a
+// directory outside of both:
+//
+// root/a/file
+// root/a/wlink -> file
+// root/up/
+// root/inlink -> a
+// root/nested -> inlink
+// root/abs -> <dir>/root/a
+// root/evil -> <dir>/outside
+// root/dots -> ../outside
+// root/trusted -> <dir>/trusted
+// root/loop -> loop
+// outside/secret
+// trusted/doc
+func confineTree(t *testing.T) (string, *capsulePolicy) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links need privileges on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "confine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir = realDir(dir)
+
+	for _, d := range []string{"root/a", "root/up", "outside", "trusted"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"root/a/file", "outside/secret", "trusted/doc"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte("data\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"root/a/wlink":  "file",
+		"root/inlink":   "a",
+		"root/nested":   "inlink",
+		"root/abs":      filepath.Join(dir, "root/a"),
+		"root/evil":     filepath.Join(dir, "outside"),
+		"root/dots":     "../outside",
+		"root/trusted":  filepath.Join(dir, "trusted"),
+		"root/loop":     "loop",
+		"root/up/ahead": "../a",
+	}
+	for l, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, l)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cp := &capsulePolicy{content: filepath.Join(dir, "root"), trustedLinks: []string{filepath.Join(dir, "trusted")}}
+	if err := cp.setMounts(nil); err != nil {
+		t.Fatal(err)
+	}
+	return dir, cp
+}
+
+func TestConfinePath(t *testing.T) {
+	dir, cp := confineTree(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+
+	tests := []struct {
+		rel     string
+		trusted []string
+		want    string
+	}{
+		{"a/file", nil, "root/a/file"},
+		{"/a/file", nil, "root/a/file"},
+		{"inlink/file", nil, "root/a/file"},
+		{"nested/file", nil, "root/a/file"},
+		{"abs/file", nil, "root/a/file"},
+		{"up/ahead/file", nil, "root/a/file"},
+		{"a/wlink", nil, "root/a/file"},
+		{"evil/secret", nil, ""},
+		{"evil", nil, ""},
+		{"dots/secret", nil, ""},
+		{"trusted/doc", nil, ""},
+		{"trusted/doc", cp.trustedLinks, "trusted/doc"},
+		{"loop", nil, ""},
+		{"../outside/secret", nil, ""},
+		{"missing", nil, "root/missing"},
+		{"up/missing/new", nil, "root/up/missing/new"},
+		{"inlink/missing", nil, "root/a/missing"},
+		{"missing/../../outside/secret", nil, ""},
+		{"missing/../a", nil, ""},
+	}
+
+	for _, tt := range tests {
+		got, err := confinePath(root, tt.rel, tt.trusted)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("confinePath(%q) = %q, want an error", tt.rel, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("confinePath(%q) failed: %s", tt.rel, err)
+		} else if want := filepath.Join(dir, tt.want); got != want {
+			t.Errorf("confinePath(%q) = %q, want %q", tt.rel, got, want)
+		}
+	}
+}
+
+func TestConfinedOpen(t *testing.T) {
+	dir, cp := confineTree(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+
+	tests := []struct {
+		path  string
+		flag  int
+		allow bool
+	}{
+		{"root/a/file", os.O_RDONLY, true},
+		{"root/nested/file", os.O_RDONLY, true},
+		{"root/a/wlink", os.O_RDONLY, true},
+		{"root/trusted/doc", os.O_RDONLY, true},
+		{"root", os.O_RDONLY, true},
+		{"root/evil/secret", os.O_RDONLY, false},
+		{"root/dots/secret", os.O_RDONLY, false},
+		{"root/loop", os.O_RDONLY, false},
+		{"outside/secret", os.O_RDONLY, false},
+		{"root/up/new", os.O_WRONLY | os.O_CREATE, true},
+		{"root/inlink/new", os.O_WRONLY | os.O_CREATE, true},
+		{"root/a/wlink", os.O_WRONLY, false},
+		{"root/evil/new", os.O_WRONLY | os.O_CREATE, false},
+		{"root/trusted/new", os.O_WRONLY | os.O_CREATE, false},
+		{"root/missing/new", os.O_WRONLY | os.O_CREATE, false},
+	}
+
+	for _, tt := range tests {
+		f, err := cp.openFile(filepath.Join(dir, tt.path), tt.flag, 0644)
+		if err == nil {
+			f.Close()
+		}
+		if tt.allow && err != nil {
+			t.Errorf("openFile(%q) failed: %s", tt.path, err)
+		} else if !tt.allow && err == nil {
+			t.Errorf("openFile(%q) succeeded, want an error", tt.path)
+		}
+	}
+
+	for _, f := range []string{"outside/new", "trusted/new"} {
+		if _, err := os.Lstat(filepath.Join(dir, f)); err == nil {
+			t.Errorf("%s was created", f)
+		}
+	}
+	if err := cp.mkdir(filepath.Join(root, "evil"), 0755); !os.IsExist(err) {
+		t.Errorf("mkdir over a link = %v, want it to exist", err)
+	}
+	if err := cp.remove(filepath.Join(root, "evil/secret")); err == nil {
+		t.Errorf("removed a file through a link out of the capsule")
+	}
+	if err := cp.chmod(filepath.Join(root, "evil"), 0777); err == nil {
+		t.Errorf("changed the mode through a link out of the capsule")
+	}
+}
+
+// A link swapped in after the path was resolved must not be followed
+func TestConfinedSwap(t *testing.T) {
+	dir, cp := confineTree(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+
+	if err := os.Mkdir(filepath.Join(root, "up/swap"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	p := cp.resolve("/up/swap/planted")
+	if p == "" {
+		t.Fatal("the path was refused before the swap")
+	}
+
+	if err := os.Remove(filepath.Join(root, "up/swap")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "outside"), filepath.Join(root, "up/swap")); err != nil {
+		t.Fatal(err)
+	}
+
+	if f, err := cp.openFile(p, os.O_WRONLY|os.O_CREATE, 0644); err == nil {
+		f.Close()
+		t.Errorf("openFile(%q) followed the swapped link", p)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "outside/planted")); err == nil {
+		t.Errorf("outside/planted was created")
+	}
+}
+
+func TestConfinedReadOnly(t *testing.T) {
+	dir, cp := confineTree(t)
+	defer os.RemoveAll(dir)
+
+	if err := cp.setMounts([]mount{{virtual: "/", physical: filepath.Join(dir, "root")}, {virtual: "/ro", physical: filepath.Join(dir, "root/a"), readOnly: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// up/ahead leads into the read-only mount
+	p := filepath.Join(dir, "root/up/ahead/new")
+	if f, err := cp.openFile(p, os.O_WRONLY|os.O_CREATE, 0644); err == nil {
+		f.Close()
+		t.Errorf("openFile(%q) wrote to a read-only mount", p)
+	}
+}
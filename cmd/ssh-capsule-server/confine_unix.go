@@ -0,0 +1,209 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// An entry in a directory that is held open, so that the path that led to
+// it can't be changed underneath us.
+type confinedEntry struct {
+	dirfd int
+	dir   string
+	name  string
+}
+
+func (e *confinedEntry) path() string {
+	return filepath.Join(e.dir, e.name)
+}
+
+func (e *confinedEntry) close() {
+	unix.Close(e.dirfd)
+}
+
+func openDir(p string) (int, error) {
+	fd, err := unix.Open(p, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	return fd, nil
+}
+
+func readlinkat(dirfd int, name string) (string, error) {
+	for size := 128; ; size *= 2 {
+		b := make([]byte, size)
+		n, err := unix.Readlinkat(dirfd, name, b)
+		if err != nil {
+			return "", err
+		}
+		if n < size {
+			return string(b[:n]), nil
+		}
+	}
+}
+
+// Walk the relative path rel below root with directory file descriptors,
+// following symbolic links like confinePath does. Each directory is opened
+// with O_NOFOLLOW so a link that appears after it was checked is refused by
+// the OS. A link in the last component is only followed when follow is set.
+func walkConfined(root string, rel string, trusted []string, follow bool) (*confinedEntry, error) {
+	realRoot := realDir(root)
+	roots := []string{realRoot}
+	for _, t := range trusted {
+		roots = append(roots, realDir(t))
+	}
+
+	dirfd, err := openDir(realRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	base := realRoot
+	current := ""
+	pending := components(rel)
+	links := 0
+
+	for len(pending) > 0 {
+		c := pending[0]
+		pending = pending[1:]
+		last := len(pending) == 0
+
+		if c == ".." {
+			unix.Close(dirfd)
+			return nil, fmt.Errorf("%s leaves %s", rel, root)
+		}
+
+		// A last component that doesn't exist is left for the caller
+		//  to create or report.
+		var st unix.Stat_t
+		err := unix.Fstatat(dirfd, c, &st, unix.AT_SYMLINK_NOFOLLOW)
+		isLink := err == nil && st.Mode&unix.S_IFMT == unix.S_IFLNK
+		if last && (err != nil || !isLink || !follow) {
+			return &confinedEntry{dirfd, filepath.Join(base, current), c}, nil
+		} else if err != nil {
+			unix.Close(dirfd)
+			return nil, &os.PathError{Op: "lstat", Path: filepath.Join(base, current, c), Err: err}
+		}
+
+		if !isLink {
+			fd, err := unix.Openat(dirfd, c, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+			unix.Close(dirfd)
+			if err != nil {
+				return nil, &os.PathError{Op: "open", Path: filepath.Join(base, current, c), Err: err}
+			}
+			dirfd = fd
+			current = filepath.Join(current, c)
+			continue
+		}
+
+		links++
+		if links > MAX_SYMLINKS {
+			unix.Close(dirfd)
+			return nil, fmt.Errorf("%s: too many levels of symbolic links", rel)
+		}
+
+		target, err := readlinkat(dirfd, c)
+		unix.Close(dirfd)
+		if err != nil {
+			return nil, &os.PathError{Op: "readlink", Path: filepath.Join(base, current, c), Err: err}
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(base, current, target)
+		}
+		target = filepath.Clean(target)
+
+		// The link target is walked again from whichever root contains it
+		found := ""
+		for _, r := range roots {
+			if within(target, r) {
+				found = r
+				break
+			}
+		}
+		if found == "" {
+			err := fmt.Errorf("%s links to %s outside of %s", rel, target, root)
+			log.Printf("Path refused: %s\n", err)
+			return nil, err
+		}
+
+		if dirfd, err = openDir(found); err != nil {
+			return nil, err
+		}
+		t, _ := filepath.Rel(found, target)
+		base = found
+		current = ""
+		pending = append(components(t), pending...)
+	}
+
+	// The path is the root itself
+	return &confinedEntry{dirfd, filepath.Join(base, current), "."}, nil
+}
+
+// Open the entry, never following a link in it
+func (e *confinedEntry) open(flag int, perm os.FileMode) (*os.File, error) {
+	fd, err := unix.Openat(e.dirfd, e.name, flag|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(perm.Perm()))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: e.path(), Err: err}
+	}
+	return os.NewFile(uintptr(fd), e.path()), nil
+}
+
+func (e *confinedEntry) mkdir(perm os.FileMode) error {
+	if err := unix.Mkdirat(e.dirfd, e.name, uint32(perm.Perm())); err != nil {
+		return &os.PathError{Op: "mkdir", Path: e.path(), Err: err}
+	}
+	return nil
+}
+
+func (e *confinedEntry) remove() error {
+	err := unix.Unlinkat(e.dirfd, e.name, 0)
+	if err == nil {
+		return nil
+	}
+	rmErr := unix.Unlinkat(e.dirfd, e.name, unix.AT_REMOVEDIR)
+	if rmErr == nil {
+		return nil
+	}
+	if rmErr != unix.ENOTDIR {
+		err = rmErr
+	}
+	return &os.PathError{Op: "remove", Path: e.path(), Err: err}
+}
+
+func (e *confinedEntry) chmod(mode os.FileMode) error {
+	f, err := e.open(os.O_RDONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Chmod(mode)
+}
+
+func (e *confinedEntry) chown(uid int, gid int) error {
+	if err := unix.Fchownat(e.dirfd, e.name, uid, gid, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "chown", Path: e.path(), Err: err}
+	}
+	return nil
+}
+
+func (e *confinedEntry) chtimes(atime time.Time, mtime time.Time) error {
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	if err := unix.UtimesNanoAt(e.dirfd, e.name, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "chtimes", Path: e.path(), Err: err}
+	}
+	return nil
+}
+
+func renameEntry(from *confinedEntry, to *confinedEntry) error {
+	if err := unix.Renameat(from.dirfd, from.name, to.dirfd, to.name); err != nil {
+		return &os.LinkError{Op: "rename", Old: from.path(), New: to.path(), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestConfinedOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner needs root")
+	}
+	dir, cp := confineTree(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	cp = cp.ownedBy(&credential{uid: 65534, gid: 65534})
+
+	f, err := cp.openFile(filepath.Join(root, "up/new"), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := cp.mkdir(filepath.Join(root, "up/dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err = cp.openFile(filepath.Join(root, "a/file"), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for name, uid := range map[string]uint32{"up/new": 65534, "up/dir": 65534, "a/file": 0} {
+		info, err := os.Stat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Uid != uid {
+			t.Errorf("%s is owned by %d, want %d", name, st.Uid, uid)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Windows has no openat(2), so the entry is only a path that was confined
+// when it was walked. A link in the last component is refused unless it is
+// followed.
+type confinedEntry struct {
+	dir    string
+	name   string
+	follow bool
+}
+
+func (e *confinedEntry) path() string {
+	return filepath.Join(e.dir, e.name)
+}
+
+func (e *confinedEntry) close() {
+}
+
+func walkConfined(root string, rel string, trusted []string, follow bool) (*confinedEntry, error) {
+	if follow {
+		p, err := confinePath(root, rel, trusted)
+		if err != nil {
+			return nil, err
+		}
+		return &confinedEntry{filepath.Dir(p), filepath.Base(p), follow}, nil
+	}
+
+	dir, err := confinePath(root, filepath.Dir(rel), trusted)
+	if err != nil {
+		return nil, err
+	}
+	return &confinedEntry{dir, filepath.Base(rel), follow}, nil
+}
+
+func (e *confinedEntry) checkLink() error {
+	if info, err := os.Lstat(e.path()); err == nil && info.Mode()&os.ModeSymlink != 0 && !e.follow {
+		return &os.PathError{Op: "open", Path: e.path(), Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (e *confinedEntry) open(flag int, perm os.FileMode) (*os.File, error) {
+	if err := e.checkLink(); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(e.path(), flag, perm)
+}
+
+func (e *confinedEntry) mkdir(perm os.FileMode) error {
+	return os.Mkdir(e.path(), perm)
+}
+
+func (e *confinedEntry) remove() error {
+	return os.Remove(e.path())
+}
+
+func (e *confinedEntry) chmod(mode os.FileMode) error {
+	if err := e.checkLink(); err != nil {
+		return err
+	}
+	return os.Chmod(e.path(), mode)
+}
+
+func (e *confinedEntry) chown(uid int, gid int) error {
+	return os.Lchown(e.path(), uid, gid)
+}
+
+func (e *confinedEntry) chtimes(atime time.Time, mtime time.Time) error {
+	if err := e.checkLink(); err != nil {
+		return err
+	}
+	return os.Chtimes(e.path(), atime, mtime)
+}
+
+func renameEntry(from *confinedEntry, to *confinedEntry) error {
+	return os.Rename(from.path(), to.path())
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	gossh "golang.org/x/crypto/ssh"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The group file puts keys into groups. An entry is a key's SHA256
+// fingerprint followed by its groups, or a key in the authorized_keys form.
+// Like in authorized_keys, anything after a full key is a comment, so its
+// groups go in a groups="..." option. Entries can start with other options
+// too: from="..." with the networks that the key can use the groups from and
+// expires="2027-01-01" with the date or RFC 3339 time when the entry stops
+// working. Anything after a # is a comment. A group line makes the members
+// of one group members of others too:
+//
+// SHA256:mVPwvezndPv/ARoIadVY98vAC0g+P/5633yTC4d/Nx0 editor
+// from="192.0.2.0/24",expires="2027-01-01" SHA256:mVPwvezndPv/ARoIadVY98vAC0g+P/5633yTC4d/Nx0 editor
+// groups="admin" ssh-ed25519 AAAA... alice@laptop
+// group admin editor site-admin
+
+// Options of authorized_keys lines that have nothing to restrict here since
+// the server doesn't allow forwarding or terminals anyway
+var IGNORED_KEY_OPTIONS = map[string]bool{
+	"restrict":            true,
+	"no-pty":              true,
+	"no-port-forwarding":  true,
+	"no-agent-forwarding": true,
+	"no-X11-forwarding":   true,
+	"no-user-rc":          true,
+}
+
+type groupEntry struct {
+	groups  []string
+	from    []*net.IPNet
+	expires time.Time
+	line    string
+}
+
+// Whether the entry applies to a client at the address at the time
+func (e *groupEntry) applies(addr net.Addr, now time.Time) bool {
+	if !e.expires.IsZero() && !now.Before(e.expires) {
+		return false
+	}
+	return len(e.from) == 0 || containsAddr(e.from, addr)
+}
+
+// Split the options at the start of an entry from the rest of it. Values
+// are in double quotes, which can have commas and spaces in them.
+func splitOptions(l string) ([]string, string, error) {
+	opts := []string{}
+	opt := strings.Builder{}
+	quoted := false
+	for i := 0; i < len(l); i++ {
+		c := l[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(l) && l[i+1] == '"':
+			opt.WriteByte('"')
+			i++
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == ',':
+			opts = append(opts, opt.String())
+			opt.Reset()
+		case !quoted && (c == ' ' || c == '\t'):
+			return append(opts, opt.String()), strings.TrimSpace(l[i:]), nil
+		default:
+			opt.WriteByte(c)
+		}
+	}
+	if quoted {
+		return nil, "", fmt.Errorf("unterminated quote")
+	}
+	return nil, "", fmt.Errorf("missing key")
+}
+
+func parseExpiry(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid expiry %q, expected a date like 2027-01-01", s)
+	}
+	return t, nil
+}
+
+// Parse a group entry, returning the account of its key. The words after a
+// fingerprint are its groups unless there is a groups option, while those
+// after a full key are its comment.
+func parseGroupEntry(l string) (string, *groupEntry, error) {
+	e := &groupEntry{}
+
+	if i := strings.Index(l, " #"); i >= 0 {
+		l = l[:i]
+	}
+	l = strings.TrimSpace(l)
+	e.line = l
+
+	fields := strings.Fields(l)
+	if len(fields) == 0 {
+		return "", nil, fmt.Errorf("missing key")
+	}
+	_, isAccount := parseFingerprint(fields[0])
+	if !isAccount && (len(fields) < 2 || !isKey(fields[0], fields[1])) {
+		opts, rest, err := splitOptions(l)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, o := range opts {
+			name, value := o, ""
+			if i := strings.Index(o, "="); i >= 0 {
+				name, value = o[:i], o[i+1:]
+			}
+			switch {
+			case name == "from":
+				if e.from, err = parseNetworks(strings.Split(value, ",")); err != nil {
+					return "", nil, err
+				}
+			case name == "expires":
+				if e.expires, err = parseExpiry(value); err != nil {
+					return "", nil, err
+				}
+			case name == "groups":
+				e.groups = strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' })
+				if len(e.groups) == 0 {
+					return "", nil, fmt.Errorf("no groups in %q", o)
+				}
+			case IGNORED_KEY_OPTIONS[name]:
+			default:
+				return "", nil, fmt.Errorf("unsupported option %q", name)
+			}
+		}
+		fields = strings.Fields(rest)
+	}
+
+	var account string
+	var words []string
+	if a, ok := parseFingerprint(fields[0]); ok {
+		account, words = a, fields[1:]
+	} else if len(fields) >= 2 {
+		pk, _, _, _, err := gossh.ParseAuthorizedKey([]byte(fields[0] + " " + fields[1]))
+		if err != nil {
+			return "", nil, err
+		}
+		account = accountName(pk)
+	} else {
+		return "", nil, fmt.Errorf("missing key")
+	}
+
+	if e.groups == nil {
+		e.groups = words
+	}
+	return account, e, nil
+}
+
+// Whether the fields are a key type and its base64 key
+func isKey(keyType string, key string) bool {
+	_, _, _, _, err := gossh.ParseAuthorizedKey([]byte(keyType + " " + key))
+	return err == nil
+}
+
+// Whether the word can be a group, which names its commands-<group> file
+func validGroupName(g string) bool {
+	return WORD_REGEX.MatchString(g)
+}
+
+// Read the group file into the entries for each account and the groups
+// that each group implies. A line that can't be read is logged and skipped
+// so that it doesn't take the rest of the groups with it.
+func readGroups(capsulePath string) (map[string][]*groupEntry, map[string][]string, error) {
+	groups := map[string][]*groupEntry{}
+	implied := map[string][]string{}
+
+	gf := filepath.Join(capsulePath, "group")
+	lines, err := readLines(gf)
+	if os.IsNotExist(err) {
+		return groups, implied, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	for i, l := range lines {
+		if len(strings.TrimSpace(l)) == 0 || strings.HasPrefix(strings.TrimSpace(l), "#") {
+			continue
+		}
+
+		fields := strings.Fields(l)
+		if fields[0] == "group" {
+			for j, f := range fields {
+				if strings.HasPrefix(f, "#") {
+					fields = fields[:j]
+					break
+				}
+			}
+			if len(fields) < 3 {
+				log.Printf("ERROR: %s:%d: a group line needs a group and the groups that it implies\n", gf, i+1)
+				continue
+			}
+			if g := invalidGroup(fields[1:]); g != "" {
+				log.Printf("ERROR: %s:%d: invalid group name %q\n", gf, i+1, g)
+				continue
+			}
+			implied[fields[1]] = append(implied[fields[1]], fields[2:]...)
+			continue
+		}
+
+		account, e, err := parseGroupEntry(l)
+		if err != nil {
+			log.Printf("ERROR: %s:%d: %s\n", gf, i+1, err)
+			continue
+		}
+		if len(e.groups) == 0 {
+			log.Printf("ERROR: %s:%d: the key has no groups, which go in groups=\"...\" before a full key\n", gf, i+1)
+			continue
+		}
+		if g := invalidGroup(e.groups); g != "" {
+			log.Printf("ERROR: %s:%d: invalid group name %q\n", gf, i+1, g)
+			continue
+		}
+		groups[account] = append(groups[account], e)
+	}
+
+	return groups, implied, nil
+}
+
+// The first of the groups that isn't a valid name, if any
+func invalidGroup(groups []string) string {
+	for _, g := range groups {
+		if !validGroupName(g) {
+			return g
+		}
+	}
+	return ""
+}
+
+// The groups of the client with the account and address, along with the
+// groups that they imply. Groups whose access lists keep the client out
+// are left out, and so are the groups that only they imply.
+func (cp *capsulePolicy) sessionGroups(account string, addr net.Addr, denied map[string]bool) []string {
+	groups := []string{}
+	seen := map[string]bool{}
+
+	var add func(g string)
+	add = func(g string) {
+		if seen[g] || denied[g] {
+			return
+		}
+		seen[g] = true
+		groups = append(groups, g)
+		for _, ig := range cp.impliedGroups[g] {
+			add(ig)
+		}
+	}
+
+	now := time.Now()
+	for _, e := range cp.groups[account] {
+		if e.applies(addr, now) {
+			for _, g := range e.groups {
+				add(g)
+			}
+		}
+	}
+	return groups
+}
+
+func groupLines(cp *capsulePolicy) []string {
+	lines := []string{}
+	for _, entries := range cp.groups {
+		for _, e := range entries {
+			lines = append(lines, e.line)
+		}
+	}
+	for g, implied := range cp.impliedGroups {
+		lines = append(lines, "group "+g+" "+strings.Join(implied, " "))
+	}
+	sort.Strings(lines)
+	return lines
+}
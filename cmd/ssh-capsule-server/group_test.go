@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/ed25519"
+	gossh "golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A key in the authorized_keys form and its account
+func testAuthorizedKey(t *testing.T) (string, string) {
+	pk, err := gossh.NewPublicKey(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(gossh.MarshalAuthorizedKey(pk))), accountName(pk)
+}
+
+func TestSplitOptions(t *testing.T) {
+	tests := []struct {
+		line string
+		opts []string
+		rest string
+		ok   bool
+	}{
+		{"restrict ssh-ed25519 AAAA", []string{"restrict"}, "ssh-ed25519 AAAA", true},
+		{"a,b=c key", []string{"a", "b=c"}, "key", true},
+		{`from="10.0.0.0/8, 192.0.2.1",groups="a b" key x`, []string{"from=10.0.0.0/8, 192.0.2.1", "groups=a b"}, "key x", true},
+		{`groups="say \"hi\"" key`, []string{`groups=say "hi"`}, "key", true},
+		{"a\tkey", []string{"a"}, "key", true},
+		{`groups="a key`, nil, "", false},
+		{"restrict", nil, "", false},
+	}
+
+	for _, tt := range tests {
+		opts, rest, err := splitOptions(tt.line)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("splitOptions(%q) = %q, %q, want an error", tt.line, opts, rest)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("splitOptions(%q) failed: %s", tt.line, err)
+		} else if !reflect.DeepEqual(opts, tt.opts) || rest != tt.rest {
+			t.Errorf("splitOptions(%q) = %q, %q, want %q, %q", tt.line, opts, rest, tt.opts, tt.rest)
+		}
+	}
+}
+
+func TestParseGroupEntry(t *testing.T) {
+	key, account := testAuthorizedKey(t)
+	fp := "SHA256:" + strings.NewReplacer("-", "+", "_", "/").Replace(account)
+
+	tests := []struct {
+		line    string
+		groups  string
+		from    int
+		expires bool
+		ok      bool
+	}{
+		// The words after a full key are its comment
+		{key + " editor", "", 0, false, true},
+		{key + " editor admin # a comment", "", 0, false, true},
+		{fp + " editor", "editor", 0, false, true},
+		{fp + " editor admin # a comment", "editor admin", 0, false, true},
+		{account + " editor", "editor", 0, false, true},
+		{key, "", 0, false, true},
+		{`groups="admin,editor" ` + key + " alice@laptop", "admin editor", 0, false, true},
+		{`from="10.0.0.0/8,192.0.2.1" ` + fp + " editor", "editor", 2, false, true},
+		{`expires="2027-01-01",restrict ` + fp + " editor", "editor", 0, true, true},
+		{`expires="2027-01-01T10:00:00Z",groups="editor" ` + key, "editor", 0, true, true},
+		{`expires="soon" ` + key + " editor", "", 0, false, false},
+		{`from="nowhere" ` + key + " editor", "", 0, false, false},
+		{`groups="" ` + key, "", 0, false, false},
+		{`command="ls" ` + key + " editor", "", 0, false, false},
+		{"ssh-ed25519 AAAAnotakey editor", "", 0, false, false},
+		{`restrict`, "", 0, false, false},
+		{"", "", 0, false, false},
+	}
+
+	for _, tt := range tests {
+		a, e, err := parseGroupEntry(tt.line)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("parseGroupEntry(%q) = %v, want an error", tt.line, e.groups)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseGroupEntry(%q) failed: %s", tt.line, err)
+			continue
+		}
+		if a != account {
+			t.Errorf("parseGroupEntry(%q) has the account %s, want %s", tt.line, a, account)
+		}
+		if strings.Join(e.groups, " ") != tt.groups || len(e.from) != tt.from || e.expires.IsZero() == tt.expires {
+			t.Errorf("parseGroupEntry(%q) = %q from %v until %v", tt.line, e.groups, e.from, e.expires)
+		}
+	}
+}
+
+// Lines that can't be read are skipped without losing the others
+func TestReadGroups(t *testing.T) {
+	key, account := testAuthorizedKey(t)
+	fp := "SHA256:" + strings.NewReplacer("-", "+", "_", "/").Replace(account)
+
+	dir, err := ioutil.TempDir("", "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lines := []string{
+		"# the editors",
+		fp + " editor",
+		key + " alice@laptop",
+		fp + " alice@laptop",
+		`groups="admin" ` + key + " alice@laptop",
+		`expires="soon" ` + key + " late",
+		key,
+		"ssh-ed25519 AAAAnotakey broken",
+		"group admin editor # and more",
+		"group lonely",
+		"group bad/name editor",
+		"",
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "group"), []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	groups, implied, err := readGroups(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{}
+	for _, e := range groups[account] {
+		got = append(got, e.groups...)
+	}
+	if !reflect.DeepEqual(got, []string{"editor", "admin"}) || len(groups) != 1 {
+		t.Errorf("the groups are %q, want editor and admin", got)
+	}
+	if !reflect.DeepEqual(implied, map[string][]string{"admin": {"editor"}}) {
+		t.Errorf("the implied groups are %q, want admin to imply editor", implied)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The server can have several host keys, one of each type. A key file that
+// doesn't exist is generated, as ed25519 unless --host-key-type says
+// otherwise or the file name has ed25519, ecdsa or rsa in it, such as
+// ssh_host_ecdsa_key. The public key is written next to it with a .pub
+// suffix.
+//
+// After a client logs in the server announces all of its keys with the
+// OpenSSH hostkeys-00 extension, so that clients that already trust one of
+// them learn the others. A new key can be added and announced for a while
+// before the old one is removed, without clients seeing the "REMOTE HOST
+// IDENTIFICATION HAS CHANGED" warning.
+
+const (
+	RSA_HOST_KEY_BITS = 3072
+
+	HOSTKEYS_REQUEST       = "hostkeys-00@openssh.com"
+	HOSTKEYS_PROVE_REQUEST = "hostkeys-prove-00@openssh.com"
+	KEEPALIVE_REQUEST      = "keepalive@openssh.com"
+)
+
+var HOST_KEY_TYPES = []string{"ed25519", "ecdsa", "rsa"}
+
+// The host keys that the server was started with
+var hostKeys []gossh.Signer
+
+// The type of key to generate for a file that doesn't exist
+func hostKeyType(path string, defaultType string) string {
+	name := strings.ToLower(filepath.Base(path))
+	for _, t := range HOST_KEY_TYPES {
+		if strings.Contains(name, t) {
+			return t
+		}
+	}
+	return defaultType
+}
+
+func generateHostKey(path string, keyType string) error {
+	var key interface{}
+	var block *pem.Block
+	switch keyType {
+	case "ed25519":
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return err
+		}
+		key, block = k, &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	case "ecdsa":
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return err
+		}
+		key, block = k, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	case "rsa":
+		k, err := rsa.GenerateKey(rand.Reader, RSA_HOST_KEY_BITS)
+		if err != nil {
+			return err
+		}
+		key, block = k, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+	default:
+		return fmt.Errorf("unknown host key type %q", keyType)
+	}
+
+	signer, err := gossh.NewSignerFromKey(key)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, block); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path+".pub", gossh.MarshalAuthorizedKey(signer.PublicKey()), 0644)
+}
+
+// Load the host keys, generating the ones that don't exist
+func loadHostKeys(paths []string, defaultType string) ([]gossh.Signer, error) {
+	signers := []gossh.Signer{}
+	types := map[string]string{}
+	for _, p := range paths {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			t := hostKeyType(p, defaultType)
+			log.Printf("Generating %s host-key: %s\n", t, p)
+			if err := generateHostKey(p, t); err != nil {
+				return nil, err
+			}
+		}
+
+		pemBytes, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := gossh.ParsePrivateKey(pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", p, err)
+		}
+
+		// Clients can only be offered one key of each type
+		t := signer.PublicKey().Type()
+		if other, ok := types[t]; ok {
+			return nil, fmt.Errorf("%s: %s already has a %s key", p, other, t)
+		}
+		types[t] = p
+
+		log.Printf("Host key %s %s\n", t, gossh.FingerprintSHA256(signer.PublicKey()))
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// The proof of the host keys that a connection may still be waiting for.
+// It is done once the proof has been signed or the client answered a
+// keepalive without asking for it.
+type hostKeyProof struct {
+	sent chan struct{}
+	once sync.Once
+}
+
+func newHostKeyProof() *hostKeyProof {
+	return &hostKeyProof{sent: make(chan struct{})}
+}
+
+func (p *hostKeyProof) done() {
+	p.once.Do(func() { close(p.sent) })
+}
+
+func (p *hostKeyProof) wait() {
+	<-p.sent
+}
+
+// The connections that have been told about the host keys
+var announced sync.Map
+
+// Announce the host keys to OpenSSH clients when the connection's first
+// session opens, since that is the first thing that happens after the client
+// has logged in.
+func announceHostKeys(handler ssh.ChannelHandler) ssh.ChannelHandler {
+	return func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+		if _, ok := announced.Load(conn); !ok && strings.Contains(string(conn.ClientVersion()), "OpenSSH") {
+			p := newHostKeyProof()
+			if _, loaded := announced.LoadOrStore(conn, p); !loaded {
+				go func() {
+					conn.Wait()
+					announced.Delete(conn)
+				}()
+				sendHostKeys(conn, p)
+			}
+		}
+		handler(srv, conn, newChan, ctx)
+	}
+}
+
+func sendHostKeys(conn *gossh.ServerConn, p *hostKeyProof) {
+	payload := []byte{}
+	for _, k := range hostKeys {
+		payload = append(payload, gossh.Marshal(&struct{ Key []byte }{k.PublicKey().Marshal()})...)
+	}
+	if _, _, err := conn.SendRequest(HOSTKEYS_REQUEST, false, payload); err != nil {
+		log.Printf("ERROR: %s\n", err)
+		p.done()
+		return
+	}
+	if len(hostKeys) < 2 {
+		p.done()
+		return
+	}
+
+	// A client that doesn't know some of the keys asks for the proof as
+	//  soon as it hears of them, so once it has answered a keepalive the
+	//  request has arrived. The session doesn't wait for the answer, only
+	//  its end does.
+	go func() {
+		conn.SendRequest(KEEPALIVE_REQUEST, true, nil)
+		p.done()
+	}()
+}
+
+// A client that learned of new keys asks the server to prove that it has
+// them by signing the session ID with each one.
+func proveHostKeys(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+	if !ok {
+		return false, nil
+	}
+	if p, ok := announced.Load(conn); ok {
+		defer p.(*hostKeyProof).done()
+	}
+
+	reply := []byte{}
+	rest := req.Payload
+	for len(rest) > 0 {
+		var blob struct {
+			Key  []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := gossh.Unmarshal(rest, &blob); err != nil {
+			return false, nil
+		}
+		rest = blob.Rest
+
+		var signer gossh.Signer
+		for _, k := range hostKeys {
+			if bytes.Equal(k.PublicKey().Marshal(), blob.Key) {
+				signer = k
+			}
+		}
+		if signer == nil {
+			return false, nil
+		}
+
+		data := gossh.Marshal(&struct {
+			Request   string
+			SessionID []byte
+			Key       []byte
+		}{HOSTKEYS_PROVE_REQUEST, conn.SessionID(), blob.Key})
+		// OpenSSH no longer trusts SHA-1 signatures from RSA keys
+		var sig *gossh.Signature
+		var err error
+		if as, ok := signer.(gossh.AlgorithmSigner); ok && signer.PublicKey().Type() == gossh.KeyAlgoRSA {
+			sig, err = as.SignWithAlgorithm(rand.Reader, data, gossh.SigAlgoRSASHA2512)
+		} else {
+			sig, err = signer.Sign(rand.Reader, data)
+		}
+		if err != nil {
+			log.Printf("ERROR: %s\n", err)
+			return false, nil
+		}
+		reply = append(reply, gossh.Marshal(&struct{ Sig []byte }{gossh.Marshal(sig)})...)
+	}
+	return true, reply
+}
+
+// Wait until any proof that the client asked for has been sent
+func waitHostKeyProof(ctx context.Context) {
+	if p, ok := announced.Load(ctx.Value(ssh.ContextKeyConn)); ok {
+		p.(*hostKeyProof).wait()
+	}
+}
+
+// A session that holds back its exit status until the host keys are
+// proved, so that a short session can't end before the proof is sent.
+type provedSession struct {
+	ssh.Session
+}
+
+func (ps provedSession) Exit(code int) error {
+	waitHostKeyProof(ps.Context())
+	return ps.Session.Exit(code)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHostKeyType(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"hostkey", "ed25519"},
+		{"/etc/ssh/ssh_host_ecdsa_key", "ecdsa"},
+		{"keys/SSH_HOST_RSA_KEY", "rsa"},
+		{"ed25519/ecdsa", "ecdsa"},
+	}
+	for _, tt := range tests {
+		if got := hostKeyType(tt.path, "ed25519"); got != tt.want {
+			t.Errorf("hostKeyType(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestLoadHostKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	paths := []string{filepath.Join(dir, "hostkey"), filepath.Join(dir, "ssh_host_ecdsa_key")}
+	signers, err := loadHostKeys(paths, "ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 2 || signers[0].PublicKey().Type() != gossh.KeyAlgoED25519 || signers[1].PublicKey().Type() != gossh.KeyAlgoECDSA256 {
+		t.Fatalf("loaded %v", signers)
+	}
+	for i, p := range paths {
+		b, err := ioutil.ReadFile(p + ".pub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pub, _, _, _, err := gossh.ParseAuthorizedKey(b); err != nil || !bytes.Equal(pub.Marshal(), signers[i].PublicKey().Marshal()) {
+			t.Errorf("%s.pub has another key: %v", p, err)
+		}
+		if info, err := os.Stat(p); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("%s was written as %v, %v", p, info, err)
+		}
+	}
+
+	// The keys are loaded again rather than replaced
+	again, err := loadHostKeys(paths, "rsa")
+	if err != nil || !bytes.Equal(again[0].PublicKey().Marshal(), signers[0].PublicKey().Marshal()) {
+		t.Errorf("loading again gave %v, %v", again, err)
+	}
+
+	if _, err := loadHostKeys([]string{paths[0], filepath.Join(dir, "other")}, "ed25519"); err == nil {
+		t.Errorf("two ed25519 keys were loaded")
+	}
+	if err := generateHostKey(filepath.Join(dir, "dsa"), "dsa"); err == nil {
+		t.Errorf("a dsa key was generated")
+	}
+}
+
+func TestProveHostKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	signers, err := loadHostKeys([]string{filepath.Join(dir, "ed25519"), filepath.Join(dir, "ecdsa")}, "ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(keys []gossh.Signer) { hostKeys = keys }(hostKeys)
+	hostKeys = signers
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &ssh.Server{
+		Handler: func(s ssh.Session) {
+			provedSession{s}.Exit(0)
+		},
+		ChannelHandlers: map[string]ssh.ChannelHandler{
+			"session": announceHostKeys(ssh.DefaultSessionHandler),
+		},
+		RequestHandlers: map[string]ssh.RequestHandler{
+			HOSTKEYS_PROVE_REQUEST: proveHostKeys,
+		},
+	}
+	server.AddHostKey(signers[0])
+	go server.Serve(l)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, chans, reqs, err := gossh.NewClientConn(conn, l.Addr().String(), &gossh.ClientConfig{
+		User:            "capsule",
+		ClientVersion:   "SSH-2.0-OpenSSH_8.9",
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go func() {
+		for ch := range chans {
+			ch.Reject(gossh.Prohibited, "")
+		}
+	}()
+
+	// Like OpenSSH the client asks for the proof as soon as it hears of
+	//  the keys, before it answers the keepalive.
+	announcements := make(chan [][]byte, 4)
+	proved := make(chan error, 4)
+	go func() {
+		for req := range reqs {
+			if req.Type == HOSTKEYS_REQUEST {
+				keys := [][]byte{}
+				rest := req.Payload
+				for len(rest) > 0 {
+					var blob struct {
+						Key  []byte
+						Rest []byte `ssh:"rest"`
+					}
+					if err := gossh.Unmarshal(rest, &blob); err != nil {
+						break
+					}
+					keys, rest = append(keys, blob.Key), blob.Rest
+				}
+				announcements <- keys
+				proved <- checkHostKeyProof(c, keys)
+			}
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		ch, chReqs, err := c.OpenChannel("session", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := ch.SendRequest("exec", true, gossh.Marshal(&struct{ Command string }{"tpl"}))
+		if !ok || err != nil {
+			t.Fatalf("exec gave %v, %v", ok, err)
+		}
+		select {
+		case req := <-chReqs:
+			if req.Type != "exit-status" {
+				t.Errorf("the session sent %s", req.Type)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the session didn't exit")
+		}
+		ch.Close()
+	}
+
+	// The keys are only announced once for the connection
+	if n := len(announcements); n != 1 {
+		t.Fatalf("the keys were announced %d times", n)
+	}
+	keys := <-announcements
+	if len(keys) != 2 || !bytes.Equal(keys[1], signers[1].PublicKey().Marshal()) {
+		t.Errorf("announced %d keys", len(keys))
+	}
+	if err := <-proved; err != nil {
+		t.Error(err)
+	}
+}
+
+// Ask the server to prove that it has the keys and check its signatures
+func checkHostKeyProof(c gossh.Conn, keys [][]byte) error {
+	payload := []byte{}
+	for _, k := range keys {
+		payload = append(payload, gossh.Marshal(&struct{ Key []byte }{k})...)
+	}
+	ok, reply, err := c.SendRequest(HOSTKEYS_PROVE_REQUEST, true, payload)
+	if err != nil || !ok {
+		return fmt.Errorf("the proof was refused: %v", err)
+	}
+
+	for _, k := range keys {
+		var blob struct {
+			Sig  []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := gossh.Unmarshal(reply, &blob); err != nil {
+			return err
+		}
+		reply = blob.Rest
+		sig := &gossh.Signature{}
+		if err := gossh.Unmarshal(blob.Sig, sig); err != nil {
+			return err
+		}
+		pub, err := gossh.ParsePublicKey(k)
+		if err != nil {
+			return err
+		}
+		data := gossh.Marshal(&struct {
+			Request   string
+			SessionID []byte
+			Key       []byte
+		}{HOSTKEYS_PROVE_REQUEST, c.SessionID(), k})
+		if err := pub.Verify(data, sig); err != nil {
+			return fmt.Errorf("%s: %s", strings.ToLower(pub.Type()), err)
+		}
+	}
+	return nil
+}
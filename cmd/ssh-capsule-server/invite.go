@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Invite codes let a visitor's key join a group without the operator
+// editing the group file. The codes are kept in the invites file of the
+// capsule directory, one per line with the group, how many more times it
+// can be used and optionally when it expires:
+//
+// k7qm2xw4hd9rtbpe editor 1 2026-11-01T12:00:00Z
+//
+// Operators can add codes to the file themselves or with the built-in invite
+// command, which can be given to an admin group with a template that limits
+// the groups, such as "invite <enum:editor> [<int>] [<word>]". A visitor runs
+// "redeem <code>" to add their key to the group file. Both only work for
+// capsules whose groups are in the capsule directory.
+//
+// Usage:
+// invite <group> [<uses>] [<expiry>]
+// redeem <code>
+//
+
+const (
+	DEFAULT_INVITE_USES   = 1
+	DEFAULT_INVITE_EXPIRY = 7 * 24 * time.Hour
+	INVITE_CODE_BYTES     = 10
+)
+
+var (
+	inviteEncoding = base32.NewEncoding("abcdefghijkmnpqrstuvwxyz23456789").WithPadding(base32.NoPadding)
+	invitesMutex   sync.Mutex
+
+	errAlreadyMember = errors.New("already a member")
+)
+
+func (cp *capsulePolicy) invitesFile() string {
+	if cp.groupFile == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(cp.groupFile), "invites")
+}
+
+// Whether a group has commands or is implied by another group
+func (cp *capsulePolicy) isGroup(group string) bool {
+	if _, ok := cp.commands["commands-"+group]; ok {
+		return true
+	}
+	for _, implied := range cp.impliedGroups {
+		for _, g := range implied {
+			if g == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Parse an expiry given as a duration from now, such as 72h, or as a date
+func parseInviteExpiry(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return now.Add(d), nil
+	}
+	return parseExpiry(s)
+}
+
+// The invites file is only written with invitesMutex held
+func writeInvites(invites string, lines []string) error {
+	data := ""
+	for _, l := range lines {
+		data += l + "\n"
+	}
+	return ioutil.WriteFile(invites, []byte(data), 0600)
+}
+
+func inviteCommand(stdout io.Writer, stderr io.Writer, args []string, cp *capsulePolicy, account string) int {
+	invites := cp.invitesFile()
+	if invites == "" {
+		io.WriteString(stderr, "invite: Invites aren't available on this capsule\n")
+		return 1
+	}
+	if len(args) == 0 || len(args) > 3 {
+		io.WriteString(stderr, "usage: invite <group> [<uses>] [<expiry>]\n")
+		return 2
+	}
+
+	group := args[0]
+	if !cp.isGroup(group) {
+		fmt.Fprintf(stderr, "invite: Unknown group %s\n", group)
+		return 1
+	}
+
+	uses := DEFAULT_INVITE_USES
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			fmt.Fprintf(stderr, "invite: Invalid number of uses %s\n", args[1])
+			return 2
+		}
+		uses = n
+	}
+
+	now := time.Now()
+	expires := now.Add(DEFAULT_INVITE_EXPIRY)
+	if len(args) > 2 {
+		var err error
+		if expires, err = parseInviteExpiry(args[2], now); err != nil {
+			fmt.Fprintf(stderr, "invite: %s\n", err)
+			return 2
+		}
+	}
+
+	b := make([]byte, INVITE_CODE_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("ERROR: %s\n", err)
+		io.WriteString(stderr, "invite: Invites are unavailable\n")
+		return 1
+	}
+	code := inviteEncoding.EncodeToString(b)
+
+	invitesMutex.Lock()
+	defer invitesMutex.Unlock()
+
+	lines, err := readLines(invites)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("ERROR: %s\n", err)
+		io.WriteString(stderr, "invite: Invites are unavailable\n")
+		return 1
+	}
+	lines = append(lines, fmt.Sprintf("%s %s %d %s", code, group, uses, expires.UTC().Format(time.RFC3339)))
+	if err := writeInvites(invites, lines); err != nil {
+		log.Printf("ERROR: %s\n", err)
+		io.WriteString(stderr, "invite: Invites are unavailable\n")
+		return 1
+	}
+
+	log.Printf("Invite %s to %s for %d uses until %s minted by %s\n", code, group, uses, expires.UTC().Format(time.RFC3339), account)
+	fmt.Fprintf(stdout, "redeem %s\n", code)
+	return 0
+}
+
+// Find the invite code, returning its group, or an empty string if the code
+// isn't valid, and the lines of the invites file with the code used up. A
+// code for a group that the client is already a member of isn't used up.
+func useInvite(invites string, code string, now time.Time, memberOf []string) (string, []string, error) {
+	lines, err := readLines(invites)
+	if err != nil && !os.IsNotExist(err) {
+		return "", nil, err
+	}
+
+	for i, l := range lines {
+		fields := strings.Fields(l)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(fields[0]), []byte(code)) != 1 {
+			continue
+		}
+		if len(fields) < 3 || len(fields) > 4 {
+			return "", nil, fmt.Errorf("%s:%d: invalid invite", invites, i+1)
+		}
+
+		uses, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return "", nil, fmt.Errorf("%s:%d: invalid number of uses %q", invites, i+1, fields[2])
+		}
+		if len(fields) == 4 {
+			expires, err := parseExpiry(fields[3])
+			if err != nil {
+				return "", nil, fmt.Errorf("%s:%d: %s", invites, i+1, err)
+			}
+			if !now.Before(expires) {
+				return "", nil, nil
+			}
+		}
+		if uses <= 0 {
+			return "", nil, nil
+		}
+		for _, g := range memberOf {
+			if g == fields[1] {
+				return g, nil, errAlreadyMember
+			}
+		}
+
+		// The code is gone once it has been used up
+		if uses == 1 {
+			lines = append(lines[:i], lines[i+1:]...)
+		} else {
+			fields[2] = strconv.Itoa(uses - 1)
+			lines[i] = strings.Join(fields, " ")
+		}
+		return fields[1], lines, nil
+	}
+
+	return "", nil, nil
+}
+
+func redeemCommand(stdout io.Writer, stderr io.Writer, args []string, cp *capsulePolicy, key gossh.PublicKey) int {
+	invites := cp.invitesFile()
+	if invites == "" {
+		io.WriteString(stderr, "redeem: Invites aren't available on this capsule\n")
+		return 1
+	}
+	if len(args) != 1 {
+		io.WriteString(stderr, "usage: redeem <code>\n")
+		return 2
+	}
+
+	invitesMutex.Lock()
+	defer invitesMutex.Unlock()
+
+	now := time.Now()
+	group, lines, err := useInvite(invites, strings.ToLower(args[0]), now, cp.memberOf)
+	if err == errAlreadyMember {
+		fmt.Fprintf(stdout, "You are already a member of %s\n", group)
+		return 0
+	} else if err != nil {
+		log.Printf("ERROR: %s\n", err)
+		io.WriteString(stderr, "redeem: Invites are unavailable\n")
+		return 1
+	}
+	if group == "" {
+		log.Printf("Invite %s not redeemed by %s\n", args[0], accountName(key))
+		io.WriteString(stderr, "redeem: Invalid or expired code\n")
+		return 1
+	}
+
+	fingerprint := gossh.FingerprintSHA256(key)
+	entry := fmt.Sprintf("%s %s # invite %s redeemed %s", fingerprint, group, args[0], now.UTC().Format(time.RFC3339))
+	// An operator may have left the last line without a newline
+	if b, err := ioutil.ReadFile(cp.groupFile); err == nil && len(b) > 0 && b[len(b)-1] != '\n' {
+		entry = "\n" + entry
+	}
+	f, err := os.OpenFile(cp.groupFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err == nil {
+		_, err = io.WriteString(f, entry+"\n")
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		log.Printf("ERROR: invite %s for %s to %s: %s\n", args[0], fingerprint, group, err)
+		io.WriteString(stderr, "redeem: Invites are unavailable\n")
+		return 1
+	}
+	log.Printf("Invite %s to %s redeemed by %s\n", args[0], group, fingerprint)
+
+	// The code is only used up once the key has joined the group, so that
+	//  a failure to join doesn't cost the visitor their invite.
+	if err := writeInvites(invites, lines); err != nil {
+		log.Printf("ERROR: invite %s wasn't used up: %s\n", args[0], err)
+	}
+
+	// The new member can use the group's commands right away
+	if err := reloadPolicy(); err != nil {
+		log.Printf("ERROR: keeping the current policy: %s\n", err)
+	}
+
+	fmt.Fprintf(stdout, "You are now a member of %s\n", group)
+	return 0
+}
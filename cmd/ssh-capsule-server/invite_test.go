@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUseInvite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "invite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	invites := filepath.Join(dir, "invites")
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	lines := []string{
+		"# invites",
+		"once editor 1",
+		"twice editor 2 2026-11-01T00:00:00Z",
+		"expired editor 5 2026-09-01T00:00:00Z",
+		"spent editor 0",
+	}
+	if err := writeInvites(invites, lines); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		code     string
+		memberOf []string
+		group    string
+		lines    []string
+		err      error
+	}{
+		{"once", nil, "editor", []string{lines[0], lines[2], lines[3], lines[4]}, nil},
+		{"twice", nil, "editor", []string{lines[0], lines[1], "twice editor 1 2026-11-01T00:00:00Z", lines[3], lines[4]}, nil},
+		{"twice", []string{"editor"}, "editor", nil, errAlreadyMember},
+		{"expired", nil, "", nil, nil},
+		{"spent", nil, "", nil, nil},
+		{"bogus", nil, "", nil, nil},
+	}
+
+	for _, tt := range tests {
+		group, got, err := useInvite(invites, tt.code, now, tt.memberOf)
+		if group != tt.group || err != tt.err || !reflect.DeepEqual(got, tt.lines) {
+			t.Errorf("useInvite(%q) = %q, %q, %v", tt.code, group, got, err)
+		}
+	}
+
+	// Finding a code doesn't use it up
+	if got, err := readLines(invites); err != nil || !reflect.DeepEqual(got, lines) {
+		t.Errorf("the invites were changed to %q, %v", got, err)
+	}
+}
+
+func TestRedeemCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "invite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := writeCapsule(t, filepath.Join(dir, "capsule"), map[string]string{
+		"commands":        "tpl\n",
+		"commands-editor": "rm <path>\n",
+		"group":           "# no newline at the end",
+	})
+	defer func(capsule string) { CLI.DefaultCapsule = capsule }(CLI.DefaultCapsule)
+	CLI.DefaultCapsule = c
+	p, err := loadPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentPolicy.Store(p)
+	cp := p.capsules[0]
+
+	var stdout, stderr bytes.Buffer
+	if code := inviteCommand(&stdout, &stderr, []string{"editor", "1", "72h"}, cp, "admin"); code != 0 {
+		t.Fatalf("invite failed with %d: %s", code, stderr.String())
+	}
+	invite := strings.Fields(stdout.String())
+	if len(invite) != 2 || invite[0] != "redeem" {
+		t.Fatalf("invite wrote %q", stdout.String())
+	}
+
+	// A code isn't used up when the key can't join the group
+	key := testKey(t)
+	saved := filepath.Join(dir, "group")
+	if err := os.Rename(cp.groupFile, saved); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(cp.groupFile, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if code := redeemCommand(&stdout, &stderr, invite[1:], cp, key); code != 1 {
+		t.Errorf("redeeming without a group file gave %d", code)
+	}
+	if err := os.Remove(cp.groupFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(saved, cp.groupFile); err != nil {
+		t.Fatal(err)
+	}
+	if lines, err := readLines(cp.invitesFile()); err != nil || len(lines) != 1 {
+		t.Errorf("the invites are %q, %v", lines, err)
+	}
+
+	stdout.Reset()
+	if code := redeemCommand(&stdout, &stderr, invite[1:], cp, key); code != 0 || stdout.String() != "You are now a member of editor\n" {
+		t.Errorf("redeem gave %d: %s%s", code, stdout.String(), stderr.String())
+	}
+	if lines, err := readLines(cp.invitesFile()); err != nil || len(lines) != 0 {
+		t.Errorf("the invite wasn't used up: %q, %v", lines, err)
+	}
+
+	// The new member has the group's commands right away
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	ncp := getPolicy().capsules[0].forClient(accountName(key), addr)
+	if got := templateLines(ncp.templates()); !reflect.DeepEqual(got, []string{"tpl", "rm <path>"}) {
+		t.Errorf("the new member has %q", got)
+	}
+
+	// The code only works once
+	if code := redeemCommand(&stdout, &stderr, invite[1:], cp, testKey(t)); code != 1 {
+		t.Errorf("a used code gave %d", code)
+	}
+}
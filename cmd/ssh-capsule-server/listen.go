@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The server can listen on several addresses at once. An address is a TCP
+// host and port, such as :1966 or [::1]:2022, or a Unix domain socket written
+// as unix:/run/ssh-capsule-server.sock. With systemd socket activation the
+// sockets that systemd passes in LISTEN_FDS are used too, so the server
+// doesn't need the privileges to bind them itself. The server listens on
+// DEFAULT_LISTEN_ADDRESS only when there are no other addresses or sockets.
+
+const (
+	DEFAULT_LISTEN_ADDRESS = ":1966"
+	UNIX_ADDRESS_PREFIX    = "unix:"
+
+	// The first file descriptor passed by systemd
+	LISTEN_FDS_START = 3
+)
+
+func listenAddress(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, UNIX_ADDRESS_PREFIX) {
+		return net.Listen("tcp", address)
+	}
+
+	// A socket left behind by a server that didn't shut down is replaced,
+	//  but not one that another server is still listening on.
+	p := address[len(UNIX_ADDRESS_PREFIX):]
+	if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		c, err := net.Dial("unix", p)
+		if err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use by another server", p)
+		} else if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, err
+		}
+		if err := os.Remove(p); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", p)
+}
+
+// The sockets passed by systemd, if the server was started by socket
+// activation.
+func systemdListeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := []net.Listener{}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("LISTEN_FD_%d", LISTEN_FDS_START+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		// The listener has its own copy of the descriptor
+		f := os.NewFile(uintptr(LISTEN_FDS_START+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("systemd socket %s: %s", name, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// Open the listeners for the addresses and any systemd sockets
+func openListeners(addresses []string) ([]net.Listener, error) {
+	listeners, err := systemdListeners()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(addresses) == 0 && len(listeners) == 0 {
+		addresses = []string{DEFAULT_LISTEN_ADDRESS}
+	}
+	for _, a := range addresses {
+		l, err := listenAddress(a)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix domain sockets are only tested on Unix")
+	}
+
+	dir, err := ioutil.TempDir("", "listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "server.sock")
+
+	// A socket that nothing listens on any more is replaced
+	l, err := net.Listen("unix", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = listenAddress(UNIX_ADDRESS_PREFIX + p)
+	if err != nil {
+		t.Fatalf("a stale socket wasn't replaced: %s", err)
+	}
+	defer l.Close()
+
+	// The socket of a running server is left alone
+	if _, err := listenAddress(UNIX_ADDRESS_PREFIX + p); err == nil {
+		t.Errorf("a running server's socket was replaced")
+	}
+	c, err := net.Dial("unix", p)
+	if err != nil {
+		t.Fatalf("the running server's socket is gone: %s", err)
+	}
+	c.Close()
+
+	// Other files aren't removed
+	f := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(f, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenAddress(UNIX_ADDRESS_PREFIX + f); err == nil {
+		t.Errorf("a file was replaced by a socket")
+	}
+}
+
+func TestOpenListeners(t *testing.T) {
+	listeners, err := openListeners([]string{"127.0.0.1:0", "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 2 || listeners[0].Addr().Network() != "tcp" {
+		t.Errorf("listeners = %v", listeners)
+	}
+	for _, l := range listeners {
+		l.Close()
+	}
+
+	if _, err := openListeners([]string{"127.0.0.1:0", "127.0.0.1:bogus"}); err == nil {
+		t.Errorf("a bad address was opened")
+	}
+}
+
+func TestSystemdListeners(t *testing.T) {
+	for _, env := range []struct {
+		pid string
+		fds string
+		ok  bool
+	}{
+		{"", "", true},
+		{"1", "2", true},
+		{strconv.Itoa(os.Getpid()), "0", true},
+		{strconv.Itoa(os.Getpid()), "many", false},
+	} {
+		os.Setenv("LISTEN_PID", env.pid)
+		os.Setenv("LISTEN_FDS", env.fds)
+		listeners, err := systemdListeners()
+		if env.ok && (err != nil || len(listeners) != 0) {
+			t.Errorf("LISTEN_PID=%q LISTEN_FDS=%q gave %v, %v", env.pid, env.fds, listeners, err)
+		} else if !env.ok && err == nil {
+			t.Errorf("LISTEN_PID=%q LISTEN_FDS=%q succeeded", env.pid, env.fds)
+		}
+		if os.Getenv("LISTEN_PID") != "" {
+			t.Errorf("LISTEN_PID was passed on")
+		}
+	}
+}
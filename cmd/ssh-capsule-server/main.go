@@ -1,57 +1,108 @@
 package main
 
 import (
-	"bufio"
 	"encoding/base64"
-	"fmt"
 	"github.com/alecthomas/kong"
 	"github.com/gliderlabs/ssh"
 	"io"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 var CLI struct {
-	ListenAddress string        `name:"listen-address" default:":1966"`
+	ListenAddress []string      `name:"listen-address" help:"An address to listen on, such as :1966, [::1]:2022 or unix:/run/ssh-capsule-server.sock. It can be given more than once. The default is :1966 unless systemd passes in sockets."`
 	IdleTimeout   time.Duration `name:"idle-timeout" default:"10s"`
-	HostKey       string        `arg name:"hostkey" help:"Host PEM key to use for this server. If the file doesn't exist then one will be generated." type:"path" required:"" env:"HOST_KEY_LOC"`
+	HostKey       string        `arg name:"hostkey" help:"Host PEM key to use for this server. If the file doesn't exist then one will be generated." type:"path" optional:"" env:"HOST_KEY_LOC"`
+	HostKeys      []string      `name:"host-key" help:"Another host key, such as one of another type or a new key that clients should learn before the old one is removed. It can be given more than once." type:"path"`
+	HostKeyType   string        `name:"host-key-type" help:"The type of host key to generate: ed25519, ecdsa or rsa." enum:"ed25519,ecdsa,rsa" default:"ed25519"`
 
-	DefaultCapsule string `arg name:"default-capsule" help:"Location of the configuration of the default capsule. If the directory doesn't exist a default capsule will be generated there." type:"path" required:"" env:"CAPSULE_LOC"`
+	DefaultCapsule string `arg name:"default-capsule" help:"Location of the configuration of the default capsule. If the directory doesn't exist a default capsule will be generated there." type:"path" optional:"" env:"CAPSULE_LOC"`
 
 	Capsule []string `name:"capsule" help:"The location of an extra capsule that will be virtually hosted with this server." type:"path"`
+
+	Config string `name:"config" help:"A JSON file describing the server and all of its capsules. Settings in the file take the place of the other options." type:"path" env:"CAPSULE_CONFIG"`
+
+	ReloadInterval time.Duration `name:"reload-interval" help:"How often to check the capsule files for changes and reload them. Set to 0 to only reload on SIGHUP." default:"5s"`
+
+	KeyConnectionRate     string   `name:"key-connection-rate" help:"Connections allowed for each key, such as 20/1m. There is no limit by default."`
+	KeyCommandRate        string   `name:"key-command-rate" help:"Commands allowed for each key, such as 60/1m."`
+	AddressConnectionRate string   `name:"address-connection-rate" help:"Connections allowed from each client network, such as 60/1m."`
+	AddressCommandRate    string   `name:"address-command-rate" help:"Commands allowed from each client network, such as 120/1m."`
+	MaxKeySessions        int      `name:"max-key-sessions" help:"The most sessions that a key can have at once. There is no limit if it is 0."`
+	IPv4Prefix            int      `name:"ipv4-prefix" help:"The IPv4 prefix length of a client network." default:"32"`
+	IPv6Prefix            int      `name:"ipv6-prefix" help:"The IPv6 prefix length of a client network." default:"64"`
+	RateExempt            []string `name:"rate-exempt" help:"A network in CIDR form, or an address, whose clients have no connection, command or session limits."`
+
+	MaxRuntime time.Duration `name:"max-runtime" help:"How long a command can run before it is stopped. There is no limit if it is 0." default:"0"`
+	MaxOutput  string        `name:"max-output" help:"The most output a command can write, such as 100M."`
+	MaxStdin   string        `name:"max-stdin" help:"The most input a command can read from the client, such as 10M."`
+
+	Sandbox     bool     `name:"sandbox" help:"Run each command in new Linux namespaces that can only see the capsule's own files and the system paths."`
+	SandboxPath []string `name:"sandbox-path" help:"A system directory that commands can read in the sandbox. The defaults are /usr, /bin, /sbin, /lib, /lib32, /lib64 and /etc."`
+
+	AuditLog string `name:"audit-log" help:"A file where every session is appended as a line of JSON." type:"path"`
+
+	MetricsAddress string `name:"metrics-address" help:"An address such as 127.0.0.1:9166 to serve Prometheus metrics at /metrics and a health check at /healthz."`
+
+	FrontendKeys string `name:"frontend-keys" help:"A file of public keys, one per line, of front-end servers that can forward sessions for their clients." type:"path"`
+
+	ProxyTrusted []string `name:"proxy-trusted" help:"A load balancer network in CIDR form whose connections start with a PROXY protocol header."`
+
+	ShutdownGrace time.Duration `name:"shutdown-grace" help:"How long running sessions can take to finish after SIGTERM or SIGINT before their commands are stopped." default:"30s"`
 }
 
 const COMMAND_LIST_TEMPLATE = `# The following is a list of commands templates that will be permitted on this server
 # It is important to choose a minimal set since anyone with access to your
 # server can run these without any authentication using this server.
 # Note the special <path> tokens represent paths relative to the capsule content
-# directory.
+# directory. Other placeholders match typed arguments: <int>, <word>, <flags>,
+# <enum:a|b|c> and <regex:...>. Arguments in [...] are optional and the last
+# argument can be followed by ... to match it one or more times. The <home-path>
+# token is a path in the visitor's own account home, created on first use.
 #
 # Default command when the user doesn't provide one.
 tpl
 #
 # Read-only commands:
-#ls <path>
+#ls [-l] [-g] [<path>]
 #tpl <path>
 #cat <path>
 #wc -c <path>
+#quota
+#redeem <word>
 #gemini <path>
 #scp -f <path>
+#sftp
 #git-upload-pack <path>
+#rsync --server --sender -<flags> . <path>
 `
 
 const GROUP_TEMPLATE = `# This is a list of public keys and additional groups
 # for the key. Additional groups can give access to additional commands.
 #
-# <key type> <key> group1 group2 ...
-# ssh-rsa ADKFJSKLDFJ... admin site-admin
-# 
+# SHA256:<fingerprint> group1 group2 ...
+# groups="group1,group2" <key type> <key> [comment]
+# groups="admin,site-admin" ssh-rsa ADKFJSKLDFJ... alice@laptop
+#
+# A full key is an authorized_keys line, so anything after it is a comment
+# and its groups go in the groups option. Entries can also start with
+# from="<cidr>,..." to limit the networks the key can use its groups from and
+# expires="2027-01-01" to end the entry on that date.
+#
+# from="192.0.2.0/24",expires="2027-01-01" SHA256:mVPwvezndPv/ARoIad... editor
+#
+# A group line gives the members of a group other groups as well.
+#
+# group admin editor
+#
 # Additional commands for a group are listed in a file commands-groupname
 # (eg. commands-admin and commands-site-admin from above example) with the
 # same format as the commands file. In these files you can put the commands
@@ -86,139 +137,250 @@ Instead of curating a complete list here of all the files that are in your capsu
 ` + "```\nssh capsule@{{ .env.HOST }} ls /\n```" + `
 `
 
-// TODO make this much more comprehensive while being safe
-var PATH_REGEX = regexp.MustCompile("^[a-zA-Z0-9\\-\\./_]+$")
+const MAX_PATH_LENGTH = 4096
+
+// Paths from clients can have any printable UTF-8 characters, including
+// spaces, but not control characters or anything that could be mistaken
+// for an option by the command that receives them.
+func validPath(p string) bool {
+	if p == "" || len(p) > MAX_PATH_LENGTH || !utf8.ValidString(p) {
+		return false
+	}
 
-func pathMatch(path string, capsuleContentPath string) string {
-	path = filepath.Clean(path)
-	if !filepath.IsAbs(path) {
-		path = "/" + path
+	if strings.HasPrefix(p, "-") {
+		return false
 	}
-	for strings.HasPrefix(path, "/..") {
-		path = path[3:]
+
+	for _, r := range p {
+		switch {
+		case unicode.IsControl(r):
+			return false
+		case r >= 0x202a && r <= 0x202e, r >= 0x2066 && r <= 0x2069:
+			// Bidirectional overrides can disguise the real path in output
+			return false
+		}
 	}
 
-	return filepath.Join(capsuleContentPath, path)
+	return true
 }
 
-func commandMatch(cmdTemplate []string, cmd []string, capsuleContentPath string) []string {
-	for i := range cmdTemplate {
-		if cmdTemplate[i] == "<path>" {
-			// Special handling for paths
-			if !PATH_REGEX.MatchString(cmd[i]) {
-				return nil
-			}
-
-			matchedPath := pathMatch(cmd[i], capsuleContentPath)
+// Convert a virtual path from a client into a physical path in one of the
+// capsule's mounts.
+func pathMatch(path string, cp *capsulePolicy) string {
+	return cp.resolve(path)
+}
 
-			if matchedPath == "" {
-				return nil
+func validateCommand(cmd []string, cp *capsulePolicy) ([]string, *commandTemplate) {
+	for _, cmdTemplate := range cp.templates() {
+		cmdMatch := cmdTemplate.match(cmd, func(kind argKind, p string) string {
+			switch kind {
+			case argHome:
+				return cp.home
+			case argHomePath:
+				return cp.resolveHome(p)
 			}
+			return pathMatch(p, cp)
+		})
 
-			cmdTemplate[i] = matchedPath
-		} else if cmdTemplate[i] != cmd[i] {
-			return nil
+		if len(cmdMatch) > 0 {
+			return cmdMatch, cmdTemplate
 		}
 	}
 
-	return cmdTemplate
+	return nil, nil
 }
 
-func validateCommand(cmd []string, capsulePath string, publicKey string) []string {
-	cmdFiles := []string{"commands"}
-
-	// Consult the group file if available to see if there are any
-	//  additional commands that this user can run.
-	groupFile, err := os.Open(filepath.Join(capsulePath, "group"))
-	if err == nil {
-		defer groupFile.Close()
-		s := bufio.NewScanner(groupFile)
-		for s.Scan() {
-			l := s.Text()
-			if len(l) > len(publicKey) && strings.HasPrefix(l, publicKey) {
-				groups := strings.Split(l[len(publicKey):], " ")
-				for _, g := range groups {
-					if g != "" {
-						cmdFiles = append(cmdFiles, fmt.Sprintf("commands-%s", g))
-					}
-				}
-				break
+func sessionHost(s ssh.Session) string {
+	host := "default"
+	for _, e := range s.Environ() {
+		if strings.HasPrefix(e, "HOST=") && len(e) > 5 {
+			host = e[5:]
+			if host == "" {
+				host = "default"
 			}
+			break
 		}
 	}
+	return host
+}
 
-	for _, cf := range cmdFiles {
-		cmdFile, err := os.Open(filepath.Join(capsulePath, cf))
-		if err != nil {
-			log.Printf("ERROR %s\n", err)
-			continue
-		}
-		defer cmdFile.Close()
-
-		capsuleContentPath := filepath.Join(capsulePath, "content")
-
-		scanner := bufio.NewScanner(cmdFile)
-		for scanner.Scan() {
-			l := scanner.Text()
-
-			if len(l) == 0 || strings.HasPrefix(l, "#") {
-				continue
-			}
-
-			cmdTemplate := strings.Split(l, " ")
+func sessionPublicKey(s ssh.Session) string {
+	return s.PublicKey().Type() + " " + base64.StdEncoding.EncodeToString(s.PublicKey().Marshal())
+}
 
-			// No command is provided and this is the default
-			if len(cmdTemplate) == 1 && len(cmd) == 0 {
-				return cmdTemplate
-			}
+func sftpSubsystem(s ssh.Session) {
+	s = provedSession{s}
+	s = clientSession(s)
+	as := startAudit(s)
+	defer as.finish()
+	s = as
+
+	host := sessionHost(s)
+	account := accountName(s.PublicKey())
+	cp := getPolicy().capsuleForHost(host).forAccount(account)
+	as.capsule(cp)
+
+	if !cp.admits(account, s.RemoteAddr()) {
+		log.Printf("Access denied: %s from %s\n", account, s.RemoteAddr())
+		io.WriteString(s.Stderr(), cp.accessMessage()+"\n")
+		s.Exit(ACCESS_DENIED_EXIT_STATUS)
+		return
+	}
+	cp = cp.forClient(account, s.RemoteAddr())
 
-			if len(cmdTemplate) != len(cmd) {
-				continue
-			}
+	endSession, ok := limits.start(s, account)
+	if !ok {
+		s.Exit(SLOW_DOWN_EXIT_STATUS)
+		return
+	}
+	defer endSession()
 
-			cmdMatch := commandMatch(cmdTemplate, cmd, capsuleContentPath)
+	if cp.backend != nil {
+		log.Printf("Forwarding to %s: sftp\n", cp.backend.address)
+		as.forwarded(cp.backend)
+		s.Exit(forwardSession(s, cp.backend))
+		return
+	}
 
-			if cmdMatch != nil && len(cmdMatch) > 0 {
-				return cmdMatch
-			}
-		}
+	allowed, writable := sftpAccess(cp)
+	if !allowed {
+		log.Printf("Subsystem blocked: sftp\n")
+		io.WriteString(s.Stderr(), "Subsystem not found\n")
+		s.Exit(127)
+		return
 	}
 
-	return nil
+	log.Printf("Starting subsystem: sftp %v\n", writable)
+	as.matched(nil, []string{"sftp"})
+	q := cp.startQuota(account)
+	defer q.finish()
+	s.Exit(sftpStatus(s, sftpCommand(s, cp, writable, q)))
 }
 
-func isCapsuleForHost(capsulePath string, host string) bool {
-	hostFile, err := os.Open(filepath.Join(capsulePath, "host"))
-	if err != nil {
-		log.Printf("ERROR: %s\n", err)
-		return false
+// Explain an sftp session that ended over quota, since the client only
+// sees a failure for the write.
+func sftpStatus(s ssh.Session, status int) int {
+	if status == QUOTA_EXIT_STATUS {
+		io.WriteString(s.Stderr(), "sftp: Disk quota exceeded\n")
 	}
+	return status
+}
 
-	scanner := bufio.NewScanner(hostFile)
-	for scanner.Scan() {
-		if host == scanner.Text() {
-			return true
+// The physical paths in the command that the session could write to
+func quotaPaths(cmd []string, cp *capsulePolicy) []string {
+	paths := []string{}
+	for _, a := range cmd[1:] {
+		if !filepath.IsAbs(a) {
+			continue
+		}
+		if m := cp.mountForPhysical(a); m != nil && !m.readOnly {
+			paths = append(paths, a)
 		}
 	}
-
-	return false
+	return paths
 }
 
 func main() {
+	// The server runs itself to set up the sandbox of each command
+	if len(os.Args) > 1 && os.Args[1] == SANDBOX_INIT {
+		sandboxInit()
+	}
+
 	kong.Parse(&CLI)
 
-	// As a convenience, let's generate the files if they don't exist
-	if _, err := os.Stat(CLI.HostKey); os.IsNotExist(err) {
-		log.Printf("Generating host-key: %s\n", CLI.HostKey)
-		kgc := exec.Command("ssh-keygen", "-m", "PEM", "-f", CLI.HostKey, "-N", "")
-		err := kgc.Run()
+	rateConfig := rateLimitConfig{
+		KeyConnections:     CLI.KeyConnectionRate,
+		KeyCommands:        CLI.KeyCommandRate,
+		AddressConnections: CLI.AddressConnectionRate,
+		AddressCommands:    CLI.AddressCommandRate,
+		MaxKeySessions:     CLI.MaxKeySessions,
+		IPv4Prefix:         &CLI.IPv4Prefix,
+		IPv6Prefix:         &CLI.IPv6Prefix,
+		Exempt:             CLI.RateExempt,
+	}
+
+	if CLI.Config != "" {
+		cfg, err := readConfig(CLI.Config)
 		if err != nil {
 			log.Printf("ERROR: %s\n", err)
 			os.Exit(1)
 		}
+		if cfg.ListenAddress != "" || len(cfg.ListenAddresses) > 0 {
+			CLI.ListenAddress = cfg.ListenAddresses
+			if cfg.ListenAddress != "" {
+				CLI.ListenAddress = append([]string{cfg.ListenAddress}, CLI.ListenAddress...)
+			}
+		}
+		if cfg.IdleTimeout.Duration != 0 {
+			CLI.IdleTimeout = cfg.IdleTimeout.Duration
+		}
+		if cfg.ReloadInterval != nil {
+			CLI.ReloadInterval = cfg.ReloadInterval.Duration
+		}
+		if cfg.HostKey != "" {
+			CLI.HostKey = cfg.HostKey
+		}
+		if len(cfg.HostKeys) > 0 {
+			CLI.HostKeys = cfg.HostKeys
+		}
+		if cfg.HostKeyType != "" {
+			CLI.HostKeyType = cfg.HostKeyType
+		}
+		if cfg.RateLimits != nil {
+			rateConfig = *cfg.RateLimits
+		}
+		if cfg.MaxRuntime != nil {
+			CLI.MaxRuntime = cfg.MaxRuntime.Duration
+		}
+		if cfg.MaxOutput != "" {
+			CLI.MaxOutput = cfg.MaxOutput
+		}
+		if cfg.MaxStdin != "" {
+			CLI.MaxStdin = cfg.MaxStdin
+		}
+		if cfg.Sandbox {
+			CLI.Sandbox = true
+		}
+		if len(cfg.SandboxPaths) > 0 {
+			CLI.SandboxPath = cfg.SandboxPaths
+		}
+		if cfg.AuditLog != "" {
+			CLI.AuditLog = cfg.AuditLog
+		}
+		if cfg.MetricsAddress != "" {
+			CLI.MetricsAddress = cfg.MetricsAddress
+		}
+		if len(cfg.FrontendKeys) > 0 {
+			if err := readFrontendKeys(cfg.FrontendKeys); err != nil {
+				log.Printf("ERROR: %s\n", err)
+				os.Exit(1)
+			}
+		}
+		if len(cfg.ProxyTrusted) > 0 {
+			CLI.ProxyTrusted = cfg.ProxyTrusted
+		}
+		if cfg.ShutdownGrace != nil {
+			CLI.ShutdownGrace = cfg.ShutdownGrace.Duration
+		}
+	} else if CLI.DefaultCapsule == "" {
+		log.Printf("ERROR: a default capsule or --config is required\n")
+		os.Exit(1)
+	}
+
+	if CLI.HostKey == "" {
+		log.Printf("ERROR: a host key is required\n")
+		os.Exit(1)
+	}
+
+	// As a convenience, let's generate the files if they don't exist
+	signers, err := loadHostKeys(append([]string{CLI.HostKey}, CLI.HostKeys...), CLI.HostKeyType)
+	if err != nil {
+		log.Printf("ERROR: %s\n", err)
+		os.Exit(1)
 	}
+	hostKeys = signers
 
-	if _, err := os.Stat(CLI.DefaultCapsule); os.IsNotExist(err) {
+	if _, err := os.Stat(CLI.DefaultCapsule); CLI.DefaultCapsule != "" && os.IsNotExist(err) {
 		log.Printf("Generating default capsule: %s\n", CLI.DefaultCapsule)
 		err := os.Mkdir(CLI.DefaultCapsule, 0700)
 		if err != nil {
@@ -274,39 +436,115 @@ func main() {
 		}
 	}
 
+	p, err := loadPolicy()
+	if err != nil {
+		log.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+	currentPolicy.Store(p)
+	metrics.policyLoaded(nil)
+	go watchPolicy(CLI.ReloadInterval)
+
+	limits, err = newRateLimits(rateConfig)
+	if err != nil {
+		log.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	defaultLimits.runtime = CLI.MaxRuntime
+	for _, l := range []struct {
+		size  string
+		limit *int64
+	}{
+		{CLI.MaxOutput, &defaultLimits.output},
+		{CLI.MaxStdin, &defaultLimits.stdin},
+	} {
+		if l.size == "" {
+			continue
+		}
+		if *l.limit, err = parseSize(l.size); err != nil {
+			log.Printf("ERROR: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if CLI.Sandbox {
+		if err := sandboxSupported(); err != nil {
+			log.Printf("ERROR: %s\n", err)
+			os.Exit(1)
+		}
+		if len(CLI.SandboxPath) == 0 {
+			CLI.SandboxPath = DEFAULT_SANDBOX_PATHS
+		}
+	}
+
+	if CLI.AuditLog != "" {
+		if auditLog, err = openAuditLog(CLI.AuditLog); err != nil {
+			log.Printf("ERROR: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if CLI.MetricsAddress != "" {
+		if err := serveMetrics(CLI.MetricsAddress); err != nil {
+			log.Printf("ERROR: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
 	server := &ssh.Server{
-		Addr:        CLI.ListenAddress,
-		IdleTimeout: CLI.IdleTimeout,
+		IdleTimeout:  CLI.IdleTimeout,
+		ConnCallback: limits.connCallback,
+		SubsystemHandlers: map[string]ssh.SubsystemHandler{
+			"sftp": sftpSubsystem,
+		},
+		ChannelHandlers: map[string]ssh.ChannelHandler{
+			"session": announceHostKeys(ssh.DefaultSessionHandler),
+		},
+		RequestHandlers: map[string]ssh.RequestHandler{
+			HOSTKEYS_PROVE_REQUEST: proveHostKeys,
+		},
 	}
 
 	server.Handle(func(s ssh.Session) {
-		host := "default"
-		for _, e := range s.Environ() {
-			if strings.HasPrefix(e, "HOST=") && len(e) > 5 {
-				host = e[5:]
-				if host == "" {
-					host = "default"
-				}
-				break
-			}
-		}
-		pubkey := s.PublicKey().Type() + " " + base64.StdEncoding.EncodeToString(s.PublicKey().Marshal())
+		s = provedSession{s}
+		s = clientSession(s)
+		as := startAudit(s)
+		defer as.finish()
+		s = as
+
+		host := sessionHost(s)
+		pubkey := sessionPublicKey(s)
 
 		log.Printf("Command requested: %v\n", s.Command())
 
-		capsule := CLI.DefaultCapsule
-		if host != "default" && !isCapsuleForHost(capsule, host) {
-			// Let's try one of the alternate capsules
-			//  for a match.
-			for _, c := range CLI.Capsule {
-				if isCapsuleForHost(c, host) {
-					capsule = c
-					break
-				}
-			}
+		account := accountName(s.PublicKey())
+		endSession, ok := limits.start(s, account)
+		if !ok {
+			s.Exit(SLOW_DOWN_EXIT_STATUS)
+			return
 		}
+		defer endSession()
 
-		cmd := validateCommand(s.Command(), capsule, pubkey)
+		cp := getPolicy().capsuleForHost(host).forAccount(account)
+		as.capsule(cp)
+
+		if !cp.admits(account, s.RemoteAddr()) {
+			log.Printf("Access denied: %s from %s\n", account, s.RemoteAddr())
+			io.WriteString(s.Stderr(), cp.accessMessage()+"\n")
+			s.Exit(ACCESS_DENIED_EXIT_STATUS)
+			return
+		}
+		cp = cp.forClient(account, s.RemoteAddr())
+
+		if cp.backend != nil {
+			log.Printf("Forwarding to %s: %v\n", cp.backend.address, s.Command())
+			as.forwarded(cp.backend)
+			s.Exit(forwardSession(s, cp.backend))
+			return
+		}
+
+		cmd, cmdTemplate := validateCommand(s.Command(), cp)
 
 		if len(cmd) == 0 {
 			log.Printf("Command blocked: %v\n", s.Command())
@@ -318,8 +556,25 @@ func main() {
 		log.Printf("Executing command: %v\n", cmd)
 
 		// See if the command exists in the capsule's bin directory first
-		if _, err := os.Stat(filepath.Join(capsule, "bin", cmd[0])); !os.IsNotExist(err) {
-			cmd[0] = filepath.Join(capsule, "bin", cmd[0])
+		inBin := false
+		if cp.bin != "" {
+			if _, err := os.Stat(filepath.Join(cp.bin, cmd[0])); !os.IsNotExist(err) {
+				cmd[0] = filepath.Join(cp.bin, cmd[0])
+				inBin = true
+			}
+		}
+		as.matched(cmdTemplate, cmd)
+
+		cred := cp.credential(cmdTemplate)
+
+		// The account's home is created the first time a command uses it
+		if cmdTemplate.usesHome || inBin {
+			if err := cp.createHome(cred); err != nil {
+				log.Printf("ERROR: %s\n", err)
+				io.WriteString(s.Stderr(), "Account home is unavailable\n")
+				s.Exit(1)
+				return
+			}
 		}
 
 		// This command is usingo the built-in template processor
@@ -328,13 +583,17 @@ func main() {
 		// tpl [<path>]
 		//
 		if cmd[0] == "tpl" {
-			fp := "main.gmi"
+			fp := pathMatch("main.gmi", cp)
 
 			if len(cmd) == 2 {
 				fp = cmd[1]
 			}
 
-			tmpl, err := template.ParseFiles(filepath.Join(capsule, "content", fp))
+			b, err := cp.readFile(fp)
+			var tmpl *template.Template
+			if err == nil {
+				tmpl, err = template.New(filepath.Base(fp)).Parse(string(b))
+			}
 			if err != nil {
 				log.Printf("Error parsing template %s: %s\n", fp, err)
 				io.WriteString(s, "Command not found\n")
@@ -343,8 +602,9 @@ func main() {
 			}
 
 			envdata := map[string]interface{}{
-				"HOST":  host,
-				"IDENT": pubkey,
+				"HOST":    host,
+				"IDENT":   pubkey,
+				"ACCOUNT": account,
 			}
 			data := map[string]interface{}{"env": envdata}
 
@@ -368,10 +628,51 @@ func main() {
 			return
 		}
 
+		// File commands are built-in so that their output doesn't depend
+		//  on the host and they can't be given unexpected options.
+		switch cmd[0] {
+		case "ls":
+			s.Exit(lsCommand(s, s.Stderr(), cmd[1:], cp))
+			return
+		case "cat":
+			s.Exit(catCommand(s, s.Stderr(), cmd[1:], cp))
+			return
+		case "wc":
+			s.Exit(wcCommand(s, s.Stderr(), cmd[1:], cp))
+			return
+		case "quota":
+			s.Exit(quotaCommand(s, cp, account))
+			return
+		case "invite":
+			s.Exit(inviteCommand(s, s.Stderr(), cmd[1:], cp, account))
+			return
+		case "redeem":
+			s.Exit(redeemCommand(s, s.Stderr(), cmd[1:], cp, s.PublicKey()))
+			return
+		}
+
+		q := cp.startQuota(account)
+		defer q.finish()
+
+		// Both the sftp subsystem and command are served by the built-in
+		//  sftp server, never the system sftp client.
+		if cmd[0] == "sftp" {
+			_, writable := sftpAccess(cp)
+			s.Exit(sftpStatus(s, sftpCommand(s, cp, writable, q)))
+			return
+		}
+
+		// The scp protocol is handled in-process so that no external
+		//  program is run with the server's privileges.
+		if cmd[0] == "scp" {
+			s.Exit(scpCommand(s, s, s.Stderr(), cmd[1:], cp.ownedBy(cred), q))
+			return
+		}
+
 		c := exec.Command(cmd[0], cmd[1:]...)
 
-		c.Dir = filepath.Join(capsule, "content") // Current working directory is the capsule content
-		c.Env = os.Environ()                      // Copy the environment of the server
+		c.Dir = cp.content   // Current working directory is the capsule content
+		c.Env = os.Environ() // Copy the environment of the server
 
 		// Copy only certain environment variables from client
 		for _, env := range s.Environ() {
@@ -392,61 +693,100 @@ func main() {
 		// Depending on the command these may be used by that process
 		c.Env = append(c.Env, "HOST="+host)
 		c.Env = append(c.Env, "IDENT="+pubkey)
+		c.Env = append(c.Env, "ACCOUNT="+account)
+		if cp.home != "" && (cmdTemplate.usesHome || inBin) {
+			c.Env = append(c.Env, "ACCOUNT_HOME="+cp.home)
+		}
 
 		// Add the capsule's path to the PATH environment
 		for ipe, pe := range c.Env {
-			if strings.HasPrefix(pe, "PATH=") {
-				pe = "PATH=" + filepath.Join(capsule, "bin") + ":" + pe[5:]
+			if strings.HasPrefix(pe, "PATH=") && cp.bin != "" {
+				pe = "PATH=" + cp.bin + ":" + pe[5:]
 				c.Env[ipe] = pe
 				break
 			}
 		}
 
-		stdout, err := c.StdoutPipe()
-		if err != nil {
-			log.Printf("ERROR: %s\n", err)
-		}
-		stdin, err := c.StdinPipe()
-		if err != nil {
-			log.Printf("ERROR: %s\n", err)
-		}
-		stderr, err := c.StderrPipe()
-		if err != nil {
-			log.Printf("ERROR: %s\n", err)
-		}
-
-		if err := c.Start(); err != nil {
-			log.Printf("ERROR: %s\n", err)
+		if cred != nil {
+			if err := setCredential(c, cred); err != nil {
+				log.Printf("ERROR: %s\n", err)
+				io.WriteString(s.Stderr(), "Command not found\n")
+				s.Exit(127)
+				return
+			}
 		}
 
-		go func() {
-			defer stdout.Close()
-			io.Copy(s, stdout)
-		}()
-		go func() {
-			defer stdin.Close()
-			io.Copy(stdin, s)
-		}()
-		go func() {
-			defer stderr.Close()
-			io.Copy(s.Stderr(), stderr)
-		}()
-
-		if err := c.Wait(); err != nil {
-			log.Printf("ERROR: %s\n", err)
+		if CLI.Sandbox {
+			binds := cp.sandboxBinds(CLI.SandboxPath, cmdTemplate.usesHome || inBin)
+			if err := sandboxCommand(c, binds); err != nil {
+				log.Printf("ERROR: %s\n", err)
+				io.WriteString(s.Stderr(), "Command not found\n")
+				s.Exit(127)
+				return
+			}
 		}
 
-		s.Exit(c.ProcessState.ExitCode())
+		s.Exit(runProcess(s, c, cmdTemplate.processLimits(), q, quotaPaths(cmd, cp)))
 	})
 	server.SetOption(ssh.PublicKeyAuth(func(ctx ssh.Context, key ssh.PublicKey) bool {
 		// All public keys are allowed
+		metrics.authAttempt("publickey", true)
 		return true
 	}))
 	server.SetOption(ssh.PasswordAuth(func(ctx ssh.Context, pass string) bool {
 		// Passwords are never correct
+		metrics.authAttempt("password", false)
 		return false
 	}))
-	server.SetOption(ssh.HostKeyFile(CLI.HostKey))
-	log.Printf("Server started on addresss %s", CLI.ListenAddress)
-	log.Fatal(server.ListenAndServe())
+	for _, k := range hostKeys {
+		server.AddHostKey(k)
+	}
+	if CLI.FrontendKeys != "" {
+		lines, err := readLines(CLI.FrontendKeys)
+		if err == nil {
+			keys := []string{}
+			for _, l := range lines {
+				if strings.TrimSpace(l) != "" && !strings.HasPrefix(l, "#") {
+					keys = append(keys, l)
+				}
+			}
+			err = readFrontendKeys(keys)
+		}
+		if err != nil {
+			log.Printf("ERROR: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	proxies, err := parseNetworks(CLI.ProxyTrusted)
+	if err != nil {
+		log.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	listeners, err := openListeners(CLI.ListenAddress)
+	if err != nil {
+		log.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+	if len(proxies) > 0 {
+		for i, l := range listeners {
+			listeners[i] = &proxyListener{l, proxies}
+		}
+	}
+
+	shutdown := handleShutdown(server, CLI.ShutdownGrace)
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		log.Printf("Server started on address %s", l.Addr())
+		go func(l net.Listener) {
+			errs <- server.Serve(l)
+		}(l)
+	}
+	for range listeners {
+		if err := <-errs; err != ssh.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}
+	<-shutdown
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidPath(t *testing.T) {
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{"/index.gmi", true},
+		{"my notes/día 1.gmi", true},
+		{"日記/今日.gmi", true},
+		{"a-b_c.d", true},
+		{"'quoted' $(not run)", true},
+		{"", false},
+		{"-rf", false},
+		{"--help", false},
+		{"a\nb", false},
+		{"a\x00b", false},
+		{"a\tb", false},
+		{"a\x1b[31mb", false},
+		{"a‮b", false},
+		{"a⁦b", false},
+		{"\xff\xfe", false},
+		{strings.Repeat("a", MAX_PATH_LENGTH), true},
+		{strings.Repeat("a", MAX_PATH_LENGTH+1), false},
+	}
+
+	for _, tt := range tests {
+		if ok := validPath(tt.path); ok != tt.ok {
+			t.Errorf("validPath(%q) = %v, want %v", tt.path, ok, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With --metrics-address the server listens for HTTP on that address with
+// Prometheus metrics in the text format at /metrics and a health check at
+// /healthz. It should only be reachable by the monitoring system.
+//
+// Sessions end as allowed when a template matched and the command exited
+// with 0, failed when it matched but exited with another status and blocked
+// when no template matched or a rate limit refused it.
+
+var DURATION_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+type histogram struct {
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+type labels [2]string
+
+type serverMetrics struct {
+	mutex sync.Mutex
+
+	activeSessions int64
+	sessions       map[labels]int64
+	durations      map[string]*histogram
+	bytes          map[labels]int64
+	auth           map[labels]int64
+
+	reloads          map[string]int64
+	lastReload       time.Time
+	lastReloadFailed bool
+}
+
+var metrics = &serverMetrics{
+	sessions:  map[labels]int64{},
+	durations: map[string]*histogram{},
+	bytes:     map[labels]int64{},
+	auth:      map[labels]int64{},
+	reloads:   map[string]int64{},
+}
+
+func (m *serverMetrics) sessionStarted() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.activeSessions++
+}
+
+func (m *serverMetrics) sessionEnded(r *auditRecord, allowed bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.activeSessions--
+
+	outcome := "blocked"
+	if allowed && r.Exit != nil && *r.Exit == 0 {
+		outcome = "allowed"
+	} else if allowed {
+		outcome = "failed"
+	}
+	m.sessions[labels{r.Capsule, outcome}]++
+	m.bytes[labels{r.Capsule, "in"}] += r.BytesIn
+	m.bytes[labels{r.Capsule, "out"}] += r.BytesOut
+
+	if !allowed {
+		return
+	}
+	h, ok := m.durations[r.Capsule]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(DURATION_BUCKETS))}
+		m.durations[r.Capsule] = h
+	}
+	for i, b := range DURATION_BUCKETS {
+		if r.Duration <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += r.Duration
+	h.count++
+}
+
+func (m *serverMetrics) active() int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.activeSessions
+}
+
+func (m *serverMetrics) authAttempt(method string, accepted bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	result := "rejected"
+	if accepted {
+		result = "accepted"
+	}
+	m.auth[labels{method, result}]++
+}
+
+func (m *serverMetrics) policyLoaded(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.lastReload = time.Now()
+	m.lastReloadFailed = err != nil
+	if err != nil {
+		m.reloads["failure"]++
+	} else {
+		m.reloads["success"]++
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedLabels(m map[labels]int64) []labels {
+	keys := []labels{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
+
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeCounters(w io.Writer, name string, names [2]string, m map[labels]int64) {
+	for _, l := range sortedLabels(m) {
+		fmt.Fprintf(w, "%s{%s=\"%s\",%s=\"%s\"} %d\n", name, names[0], labelEscaper.Replace(l[0]), names[1], labelEscaper.Replace(l[1]), m[l])
+	}
+}
+
+// Write the metrics in the Prometheus text format
+func (m *serverMetrics) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	writeHeader(w, "ssh_capsule_active_sessions", "gauge", "Sessions that are running now.")
+	fmt.Fprintf(w, "ssh_capsule_active_sessions %d\n", m.activeSessions)
+
+	writeHeader(w, "ssh_capsule_sessions_total", "counter", "Sessions that have ended by capsule and outcome.")
+	writeCounters(w, "ssh_capsule_sessions_total", [2]string{"capsule", "outcome"}, m.sessions)
+
+	writeHeader(w, "ssh_capsule_command_duration_seconds", "histogram", "How long allowed commands ran.")
+	capsules := []string{}
+	for c := range m.durations {
+		capsules = append(capsules, c)
+	}
+	sort.Strings(capsules)
+	for _, c := range capsules {
+		h := m.durations[c]
+		l := labelEscaper.Replace(c)
+		for i, b := range DURATION_BUCKETS {
+			fmt.Fprintf(w, "ssh_capsule_command_duration_seconds_bucket{capsule=\"%s\",le=\"%g\"} %d\n", l, b, h.counts[i])
+		}
+		fmt.Fprintf(w, "ssh_capsule_command_duration_seconds_bucket{capsule=\"%s\",le=\"+Inf\"} %d\n", l, h.count)
+		fmt.Fprintf(w, "ssh_capsule_command_duration_seconds_sum{capsule=\"%s\"} %g\n", l, h.sum)
+		fmt.Fprintf(w, "ssh_capsule_command_duration_seconds_count{capsule=\"%s\"} %d\n", l, h.count)
+	}
+
+	writeHeader(w, "ssh_capsule_bytes_total", "counter", "Bytes transferred with clients by capsule and direction.")
+	writeCounters(w, "ssh_capsule_bytes_total", [2]string{"capsule", "direction"}, m.bytes)
+
+	writeHeader(w, "ssh_capsule_auth_attempts_total", "counter", "Authentication attempts by method and result.")
+	writeCounters(w, "ssh_capsule_auth_attempts_total", [2]string{"method", "result"}, m.auth)
+
+	writeHeader(w, "ssh_capsule_policy_reloads_total", "counter", "Policy loads by result.")
+	for _, r := range []string{"failure", "success"} {
+		fmt.Fprintf(w, "ssh_capsule_policy_reloads_total{result=\"%s\"} %d\n", r, m.reloads[r])
+	}
+
+	writeHeader(w, "ssh_capsule_policy_last_reload_success", "gauge", "Whether the last policy load succeeded.")
+	success := 1
+	if m.lastReloadFailed {
+		success = 0
+	}
+	fmt.Fprintf(w, "ssh_capsule_policy_last_reload_success %d\n", success)
+
+	writeHeader(w, "ssh_capsule_policy_last_reload_timestamp_seconds", "gauge", "When the policy was last loaded.")
+	fmt.Fprintf(w, "ssh_capsule_policy_last_reload_timestamp_seconds %d\n", m.lastReload.Unix())
+}
+
+func serveMetrics(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.write(w)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := currentPolicy.Load().(*policy); !ok || p == nil {
+			http.Error(w, "no policy", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok\n")
+	})
+
+	log.Printf("Metrics server started on address %s", address)
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Printf("ERROR: metrics server: %s\n", err)
+		}
+	}()
+	return nil
+}
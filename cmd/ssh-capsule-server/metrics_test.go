@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	m := &serverMetrics{
+		sessions:  map[labels]int64{},
+		durations: map[string]*histogram{},
+		bytes:     map[labels]int64{},
+		auth:      map[labels]int64{},
+		reloads:   map[string]int64{},
+	}
+
+	zero, one := 0, 1
+	for _, s := range []struct {
+		r       auditRecord
+		allowed bool
+	}{
+		{auditRecord{Capsule: "b", Exit: &zero, BytesIn: 10, BytesOut: 100, Duration: 0.02}, true},
+		{auditRecord{Capsule: "b", Exit: &one, BytesOut: 5, Duration: 3}, true},
+		{auditRecord{Capsule: `a "quoted"` + "\n", Exit: &one}, false},
+	} {
+		m.sessionStarted()
+		m.sessionEnded(&s.r, s.allowed)
+	}
+	m.sessionStarted()
+	m.authAttempt("publickey", true)
+	m.authAttempt("publickey", true)
+	m.authAttempt("password", false)
+	m.policyLoaded(nil)
+	m.policyLoaded(errors.New("bad commands"))
+	m.lastReload = time.Unix(1625140800, 0)
+
+	buf := &bytes.Buffer{}
+	m.write(buf)
+
+	want := `# HELP ssh_capsule_active_sessions Sessions that are running now.
+# TYPE ssh_capsule_active_sessions gauge
+ssh_capsule_active_sessions 1
+# HELP ssh_capsule_sessions_total Sessions that have ended by capsule and outcome.
+# TYPE ssh_capsule_sessions_total counter
+ssh_capsule_sessions_total{capsule="a \"quoted\"\n",outcome="blocked"} 1
+ssh_capsule_sessions_total{capsule="b",outcome="allowed"} 1
+ssh_capsule_sessions_total{capsule="b",outcome="failed"} 1
+# HELP ssh_capsule_command_duration_seconds How long allowed commands ran.
+# TYPE ssh_capsule_command_duration_seconds histogram
+ssh_capsule_command_duration_seconds_bucket{capsule="b",le="0.005"} 0
+ssh_capsule_command_duration_seconds_bucket{capsule="b",le="0.01"} 0
+ssh_capsule_command_duration_seconds_bucket{capsule="b",le="0.025"} 1
+ssh_capsule_command_duration_seconds_bucket{capsule="b",le="0.05"} 1
+ssh_capsule_command_duration_seconds_bucket{capsule="b",le="0.1"} 1
+ssh_capsule_command_duration_seconds_bucket{capsule="b",le="0.25"} 1
+ssh_capsule_command_duration_seconds_bucket{capsule="b",le="0.5"} 1
+ssh_capsule_command_duration_seconds_bucket{capsule="b",le="1"} 1
+ssh_capsule_command_duration_seconds_bucket{capsule="b",le="2.5"} 1
+ssh_capsule_command_duration_seconds_bucket{capsule="b",le="5"} 2
+ssh_capsule_command_duration_seconds_bucket{capsule="b",le="10"} 2
+ssh_capsule_command_duration_seconds_bucket{capsule="b",le="30"} 2
+ssh_capsule_command_duration_seconds_bucket{capsule="b",le="60"} 2
+ssh_capsule_command_duration_seconds_bucket{capsule="b",le="300"} 2
+ssh_capsule_command_duration_seconds_bucket{capsule="b",le="+Inf"} 2
+ssh_capsule_command_duration_seconds_sum{capsule="b"} 3.02
+ssh_capsule_command_duration_seconds_count{capsule="b"} 2
+# HELP ssh_capsule_bytes_total Bytes transferred with clients by capsule and direction.
+# TYPE ssh_capsule_bytes_total counter
+ssh_capsule_bytes_total{capsule="a \"quoted\"\n",direction="in"} 0
+ssh_capsule_bytes_total{capsule="a \"quoted\"\n",direction="out"} 0
+ssh_capsule_bytes_total{capsule="b",direction="in"} 10
+ssh_capsule_bytes_total{capsule="b",direction="out"} 105
+# HELP ssh_capsule_auth_attempts_total Authentication attempts by method and result.
+# TYPE ssh_capsule_auth_attempts_total counter
+ssh_capsule_auth_attempts_total{method="password",result="rejected"} 1
+ssh_capsule_auth_attempts_total{method="publickey",result="accepted"} 2
+# HELP ssh_capsule_policy_reloads_total Policy loads by result.
+# TYPE ssh_capsule_policy_reloads_total counter
+ssh_capsule_policy_reloads_total{result="failure"} 1
+ssh_capsule_policy_reloads_total{result="success"} 1
+# HELP ssh_capsule_policy_last_reload_success Whether the last policy load succeeded.
+# TYPE ssh_capsule_policy_last_reload_success gauge
+ssh_capsule_policy_last_reload_success 0
+# HELP ssh_capsule_policy_last_reload_timestamp_seconds When the policy was last loaded.
+# TYPE ssh_capsule_policy_last_reload_timestamp_seconds gauge
+ssh_capsule_policy_last_reload_timestamp_seconds 1625140800
+`
+	if buf.String() != want {
+		got, exp := strings.Split(buf.String(), "\n"), strings.Split(want, "\n")
+		for i := 0; i < len(got) && i < len(exp); i++ {
+			if got[i] != exp[i] {
+				t.Fatalf("line %d is\n%s\nwant\n%s", i+1, got[i], exp[i])
+			}
+		}
+		t.Fatalf("the metrics have %d lines, want %d", len(got), len(exp))
+	}
+}
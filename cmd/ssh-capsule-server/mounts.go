@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Virtual paths are bound to physical directories with a mount table. By
+// default the capsule content directory is mounted at the root. The optional
+// content-location file in the capsule directory changes that. A line with
+// only a directory mounts it at the root and other lines mount a directory
+// at a virtual path, optionally read-only:
+//
+// /var/srv/site
+// /downloads /mnt/big ro
+//
+
+type mount struct {
+	virtual  string
+	physical string
+	real     string
+	readOnly bool
+}
+
+// The mount's name as a directory entry of its parent
+type mountInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (mi mountInfo) Name() string {
+	return mi.name
+}
+
+func cleanVirtualPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func parseMount(fields []string) (mount, error) {
+	m := mount{virtual: "/"}
+
+	switch {
+	case len(fields) == 1:
+		m.physical = fields[0]
+	case len(fields) == 2 && fields[1] == "ro":
+		m.physical = fields[0]
+		m.readOnly = true
+	case len(fields) == 2:
+		m.virtual = cleanVirtualPath(fields[0])
+		m.physical = fields[1]
+	case len(fields) == 3 && fields[2] == "ro":
+		m.virtual = cleanVirtualPath(fields[0])
+		m.physical = fields[1]
+		m.readOnly = true
+	default:
+		return m, fmt.Errorf("invalid mount %q", strings.Join(fields, " "))
+	}
+
+	if !filepath.IsAbs(m.physical) {
+		return m, fmt.Errorf("mount %s must be an absolute path", m.physical)
+	}
+	m.physical = filepath.Clean(m.physical)
+
+	return m, nil
+}
+
+func readContentLocation(capsulePath string) ([]mount, error) {
+	lines, err := readLines(filepath.Join(capsulePath, "content-location"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	mounts := []mount{}
+	for i, l := range lines {
+		if len(strings.TrimSpace(l)) == 0 || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		m, err := parseMount(strings.Fields(l))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filepath.Join(capsulePath, "content-location"), i+1, err)
+		}
+		mounts = append(mounts, m)
+	}
+
+	return mounts, nil
+}
+
+// Set up the capsule's mount table with the content directory at the root
+// unless another directory is mounted there.
+func (cp *capsulePolicy) setMounts(mounts []mount) error {
+	cp.mounts = []mount{}
+	hasRoot := false
+	seen := map[string]bool{}
+	for _, m := range mounts {
+		if seen[m.virtual] {
+			return fmt.Errorf("%s is mounted more than once", m.virtual)
+		}
+		seen[m.virtual] = true
+		if m.virtual == "/" {
+			hasRoot = true
+			cp.content = m.physical
+		}
+		cp.mounts = append(cp.mounts, m)
+	}
+	if !hasRoot {
+		cp.mounts = append(cp.mounts, mount{virtual: "/", physical: cp.content})
+	}
+
+	// Resolved paths have no symbolic links, so they are compared
+	// with the real path of the mount too.
+	for i := range cp.mounts {
+		cp.mounts[i].real = realDir(cp.mounts[i].physical)
+	}
+
+	// The longest virtual paths are matched first
+	sort.Slice(cp.mounts, func(i, j int) bool {
+		return len(cp.mounts[i].virtual) > len(cp.mounts[j].virtual)
+	})
+
+	return nil
+}
+
+func (cp *capsulePolicy) mountFor(vp string) *mount {
+	vp = cleanVirtualPath(vp)
+	for i, m := range cp.mounts {
+		if m.virtual == "/" || vp == m.virtual || strings.HasPrefix(vp, m.virtual+"/") {
+			return &cp.mounts[i]
+		}
+	}
+	return nil
+}
+
+// Convert a virtual path from the client into a physical path, or an empty
+// string if the path isn't permitted.
+func (cp *capsulePolicy) resolve(vp string) string {
+	vp = cleanVirtualPath(vp)
+	m := cp.mountFor(vp)
+	if m == nil {
+		return ""
+	}
+
+	p, err := confinePath(m.physical, strings.TrimPrefix(vp, m.virtual), cp.trustedLinks)
+	if err != nil {
+		log.Printf("Path refused: %s\n", err)
+		return ""
+	}
+	return p
+}
+
+func (cp *capsulePolicy) mountForPhysical(p string) *mount {
+	var found *mount
+	foundRoot := ""
+	for i, m := range cp.mounts {
+		for _, root := range []string{m.physical, m.real} {
+			if within(p, root) && (found == nil || len(root) > len(foundRoot)) {
+				found = &cp.mounts[i]
+				foundRoot = root
+			}
+		}
+	}
+	return found
+}
+
+// Convert a physical path back into the virtual path the client sees
+func (cp *capsulePolicy) virtualPath(p string) string {
+	m := cp.mountForPhysical(p)
+	if m == nil {
+		return "/"
+	}
+	root := m.physical
+	if !within(p, root) {
+		root = m.real
+	}
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return "/"
+	}
+	return path.Join(m.virtual, filepath.ToSlash(rel))
+}
+
+func (cp *capsulePolicy) readOnly(p string) bool {
+	m := cp.mountForPhysical(p)
+	return m == nil || m.readOnly
+}
+
+// Read a directory along with any mounts that appear inside of it
+func (cp *capsulePolicy) readDir(p string) ([]os.FileInfo, error) {
+	f, err := cp.openFile(p, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	vp := cp.virtualPath(p)
+	for _, m := range cp.mounts {
+		if m.virtual == "/" || path.Dir(m.virtual) != vp {
+			continue
+		}
+		info, err := os.Stat(m.physical)
+		if err != nil {
+			continue
+		}
+		name := path.Base(m.virtual)
+
+		replaced := false
+		for i, e := range entries {
+			if e.Name() == name {
+				entries[i] = mountInfo{info, name}
+				replaced = true
+			}
+		}
+		if !replaced {
+			entries = append(entries, mountInfo{info, name})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A capsule serving the content directory with any other mounts
+func testCapsule(t *testing.T, content string, mounts ...mount) *capsulePolicy {
+	cp := &capsulePolicy{name: "test", content: content}
+	if err := cp.setMounts(mounts); err != nil {
+		t.Fatal(err)
+	}
+	return cp
+}
+
+func TestParseMount(t *testing.T) {
+	abs, err := filepath.Abs("srv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		line string
+		want mount
+		ok   bool
+	}{
+		{abs, mount{virtual: "/", physical: abs}, true},
+		{abs + " ro", mount{virtual: "/", physical: abs, readOnly: true}, true},
+		{"/downloads " + abs, mount{virtual: "/downloads", physical: abs}, true},
+		{"downloads/../files/ " + abs + " ro", mount{virtual: "/files", physical: abs, readOnly: true}, true},
+		{"/downloads " + abs + " rw", mount{}, false},
+		{"/downloads srv", mount{}, false},
+		{"srv", mount{}, false},
+		{"/a /b /c /d", mount{}, false},
+	}
+
+	for _, tt := range tests {
+		m, err := parseMount(strings.Fields(tt.line))
+		if tt.ok && (err != nil || m != tt.want) {
+			t.Errorf("parseMount(%q) = %v, %v, want %v", tt.line, m, err, tt.want)
+		} else if !tt.ok && err == nil {
+			t.Errorf("parseMount(%q) succeeded, want an error", tt.line)
+		}
+	}
+}
+
+func TestMountResolution(t *testing.T) {
+	content, big, docs := filepath.FromSlash("/srv/site"), filepath.FromSlash("/mnt/big"), filepath.FromSlash("/mnt/docs")
+	cp := testCapsule(t, content,
+		mount{virtual: "/downloads", physical: big},
+		mount{virtual: "/downloads/docs", physical: docs, readOnly: true},
+	)
+
+	tests := []struct {
+		virtual  string
+		physical string
+		readOnly bool
+	}{
+		{"/", content, false},
+		{"/index.gmi", filepath.Join(content, "index.gmi"), false},
+		{"/../index.gmi", filepath.Join(content, "index.gmi"), false},
+		{"/downloadsx", filepath.Join(content, "downloadsx"), false},
+		{"/downloads", big, false},
+		{"/downloads/file", filepath.Join(big, "file"), false},
+		{"/downloads/../../etc", filepath.Join(content, "etc"), false},
+		{"/downloads/docs/a/b", filepath.Join(docs, "a/b"), true},
+	}
+
+	for _, tt := range tests {
+		p := cp.resolve(tt.virtual)
+		if p != tt.physical {
+			t.Errorf("resolve(%q) = %q, want %q", tt.virtual, p, tt.physical)
+		}
+		if ro := cp.readOnly(p); ro != tt.readOnly {
+			t.Errorf("readOnly(%q) = %v", p, ro)
+		}
+		if vp := cp.virtualPath(p); vp != cleanVirtualPath(tt.virtual) {
+			t.Errorf("virtualPath(%q) = %q, want %q", p, vp, cleanVirtualPath(tt.virtual))
+		}
+	}
+
+	// Paths that aren't mounted anywhere are never writable
+	if !cp.readOnly(filepath.FromSlash("/etc/passwd")) {
+		t.Errorf("/etc/passwd is writable")
+	}
+
+	if err := testCapsule(t, content).setMounts([]mount{{virtual: "/a", physical: big}, {virtual: "/a", physical: docs}}); err == nil {
+		t.Errorf("a path was mounted twice")
+	}
+}
+
+func TestReadContentLocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if mounts, err := readContentLocation(dir); err != nil || mounts != nil {
+		t.Errorf("without a content-location file got %v, %v", mounts, err)
+	}
+
+	big := filepath.Join(dir, "big")
+	writeCapsule(t, dir, map[string]string{
+		"content-location": "# mounts\n\n" + dir + "\n/downloads " + big + " ro\n",
+	})
+	mounts, err := readContentLocation(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 2 || mounts[0] != (mount{virtual: "/", physical: dir}) || mounts[1] != (mount{virtual: "/downloads", physical: big, readOnly: true}) {
+		t.Errorf("mounts = %v", mounts)
+	}
+
+	writeCapsule(t, dir, map[string]string{
+		"content-location": "/downloads relative\n",
+	})
+	if _, err := readContentLocation(dir); err == nil || !strings.Contains(err.Error(), "content-location:1:") {
+		t.Errorf("a relative mount gave %v, want an error with its line", err)
+	}
+}
+
+func TestReadDirMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := filepath.Join(dir, "content")
+	writeCapsule(t, filepath.Join(content, "downloads"), map[string]string{"hidden": ""})
+	writeCapsule(t, content, map[string]string{"index.gmi": ""})
+	writeCapsule(t, filepath.Join(dir, "big"), map[string]string{"file": ""})
+
+	cp := testCapsule(t, content,
+		mount{virtual: "/downloads", physical: filepath.Join(dir, "big"), readOnly: true},
+		mount{virtual: "/extra", physical: filepath.Join(dir, "big"), readOnly: true},
+	)
+	entries, err := cp.readDir(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if strings.Join(names, " ") != "downloads extra index.gmi" {
+		t.Errorf("/ has %q", names)
+	}
+
+	entries, err = cp.readDir(cp.resolve("/downloads"))
+	if err != nil || len(entries) != 1 || entries[0].Name() != "file" {
+		t.Errorf("/downloads has %v, %v", entries, err)
+	}
+}
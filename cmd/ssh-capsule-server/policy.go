@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The policy is the parsed form of the host, group and commands files of
+// every capsule. It is built once at startup and replaced as a whole when
+// the files change so that sessions never see a partially edited capsule.
+
+type capsulePolicy struct {
+	name     string
+	path     string
+	hosts    []string
+	content  string
+	bin      string
+	mounts   []mount
+	commands map[string][]*commandTemplate
+
+	// The group entries of each account, the groups that each group
+	// implies and the groups of the session's client
+	groups        map[string][]*groupEntry
+	impliedGroups map[string][]string
+	memberOf      []string
+
+	// The group file that redeemed invites are added to, if the groups
+	// are in the capsule directory
+	groupFile string
+
+	// Directories outside of the mounts that symbolic links may point into
+	trustedLinks []string
+
+	// The directory of account homes and the home of the session's account
+	homes string
+	home  string
+
+	accountQuota quota
+	capsuleQuota quota
+
+	// Another capsule server that serves the capsule, if it isn't local
+	backend *backend
+
+	// The users that run commands, or nil for the server's user
+	user       *credential
+	groupUsers map[string]*credential
+
+	// The user that gets what the built-in commands create
+	owner *credential
+
+	// The clients that are kept out of the capsule and out of its groups
+	access       *accessList
+	groupAccess  map[string]*accessList
+	accessDenied string
+}
+
+type policy struct {
+	capsules  []*capsulePolicy
+	files     []string
+	signature string
+}
+
+var (
+	currentPolicy atomic.Value
+	reloadMutex   sync.Mutex
+)
+
+func getPolicy() *policy {
+	return currentPolicy.Load().(*policy)
+}
+
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := []string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	return lines, s.Err()
+}
+
+func loadCapsulePolicy(capsulePath string) (*capsulePolicy, []string, error) {
+	cp := &capsulePolicy{
+		name:     capsulePath,
+		path:     capsulePath,
+		hosts:    []string{},
+		content:  filepath.Join(capsulePath, "content"),
+		bin:      filepath.Join(capsulePath, "bin"),
+		homes:    filepath.Join(capsulePath, "homes"),
+		commands: map[string][]*commandTemplate{},
+
+		groupUsers: map[string]*credential{},
+	}
+
+	// The directory is watched too so that new commands files are noticed
+	files := []string{
+		capsulePath,
+		filepath.Join(capsulePath, "host"),
+		filepath.Join(capsulePath, "group"),
+		filepath.Join(capsulePath, "content-location"),
+		filepath.Join(capsulePath, "trusted-links"),
+		filepath.Join(capsulePath, "quota"),
+		filepath.Join(capsulePath, "user"),
+		filepath.Join(capsulePath, "backend"),
+		filepath.Join(capsulePath, "access"),
+	}
+
+	mounts, err := readContentLocation(capsulePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cp.setMounts(mounts); err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", capsulePath, err)
+	}
+
+	trusted, err := readLines(filepath.Join(capsulePath, "trusted-links"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	for _, t := range trusted {
+		if len(t) == 0 || strings.HasPrefix(t, "#") {
+			continue
+		}
+		if !filepath.IsAbs(t) {
+			return nil, nil, fmt.Errorf("%s: %s must be an absolute path", filepath.Join(capsulePath, "trusted-links"), t)
+		}
+		cp.trustedLinks = append(cp.trustedLinks, t)
+	}
+
+	cp.accountQuota, cp.capsuleQuota, err = readQuota(capsulePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cp.user, cp.groupUsers, err = readUsers(capsulePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cp.backend, err = readBackend(capsulePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cp.access, cp.groupAccess, cp.accessDenied, err = readAccess(capsulePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hosts, err := readLines(filepath.Join(capsulePath, "host"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	for _, h := range hosts {
+		if h != "" {
+			cp.hosts = append(cp.hosts, h)
+		}
+	}
+
+	cp.groups, cp.impliedGroups, err = readGroups(capsulePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	cp.groupFile = filepath.Join(capsulePath, "group")
+
+	entries, err := ioutil.ReadDir(capsulePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, fi := range entries {
+		cf := fi.Name()
+		if cf != "commands" && !strings.HasPrefix(cf, "commands-") {
+			continue
+		}
+
+		files = append(files, filepath.Join(capsulePath, cf))
+		lines, err := readLines(filepath.Join(capsulePath, cf))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		templates := []*commandTemplate{}
+		for i, l := range lines {
+			if len(l) == 0 || strings.HasPrefix(l, "#") {
+				continue
+			}
+
+			cmdTemplate, err := parseCommandTemplate(l)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s:%d: %s", filepath.Join(capsulePath, cf), i+1, err)
+			}
+			cmdTemplate.file = cf
+			templates = append(templates, cmdTemplate)
+		}
+		cp.commands[cf] = templates
+	}
+
+	if _, ok := cp.commands["commands"]; !ok && cp.backend == nil {
+		return nil, nil, fmt.Errorf("%s: missing commands file", capsulePath)
+	}
+
+	return cp, files, nil
+}
+
+// The signature changes whenever one of the files that make up the policy
+// is added, removed or modified.
+func policySignature(files []string) string {
+	sig := strings.Builder{}
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			fmt.Fprintf(&sig, "%s:missing;", f)
+			continue
+		}
+		fmt.Fprintf(&sig, "%s:%d:%d;", f, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return sig.String()
+}
+
+func loadDirPolicy(capsulePaths []string) (*policy, error) {
+	p := &policy{files: []string{}}
+
+	for _, c := range capsulePaths {
+		cp, files, err := loadCapsulePolicy(c)
+		if err != nil {
+			return nil, err
+		}
+		p.capsules = append(p.capsules, cp)
+		p.files = append(p.files, files...)
+	}
+
+	p.signature = policySignature(p.files)
+	return p, nil
+}
+
+// Load the policy from the configuration file if there is one, otherwise
+// from the capsule directories.
+func loadPolicy() (*policy, error) {
+	if CLI.Config != "" {
+		return loadConfigPolicy(CLI.Config)
+	}
+	return loadDirPolicy(append([]string{CLI.DefaultCapsule}, CLI.Capsule...))
+}
+
+// The capsule that serves this host, or the default capsule if no
+// capsule lists the host.
+func (p *policy) capsuleForHost(host string) *capsulePolicy {
+	if host != "default" {
+		for _, cp := range p.capsules {
+			for _, h := range cp.hosts {
+				if h == host {
+					return cp
+				}
+			}
+		}
+	}
+	return p.capsules[0]
+}
+
+// The command templates that are available to the session's client from
+// the capsule's commands file and any commands files for its groups.
+func (cp *capsulePolicy) templates() []*commandTemplate {
+	templates := append([]*commandTemplate{}, cp.commands["commands"]...)
+	for _, g := range cp.memberOf {
+		templates = append(templates, cp.commands["commands-"+g]...)
+	}
+	return templates
+}
+
+func templateLines(templates []*commandTemplate) []string {
+	lines := []string{}
+	for _, t := range templates {
+		lines = append(lines, t.line)
+	}
+	return lines
+}
+
+func mountLines(mounts []mount) []string {
+	lines := []string{}
+	for _, m := range mounts {
+		l := m.virtual + " -> " + m.physical
+		if m.readOnly {
+			l += " (read-only)"
+		}
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+func diffLines(old []string, new []string) ([]string, []string) {
+	oldSet := map[string]bool{}
+	for _, l := range old {
+		oldSet[l] = true
+	}
+	newSet := map[string]bool{}
+	for _, l := range new {
+		newSet[l] = true
+	}
+
+	added := []string{}
+	for _, l := range new {
+		if !oldSet[l] {
+			added = append(added, l)
+		}
+	}
+	removed := []string{}
+	for _, l := range old {
+		if !newSet[l] {
+			removed = append(removed, l)
+		}
+	}
+	return added, removed
+}
+
+// Describe the differences between two policies for the log
+func diffPolicy(old *policy, new *policy) []string {
+	changes := []string{}
+
+	oldCapsules := map[string]*capsulePolicy{}
+	for _, cp := range old.capsules {
+		oldCapsules[cp.name] = cp
+	}
+
+	for _, cp := range new.capsules {
+		ocp, ok := oldCapsules[cp.name]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("%s: added capsule", cp.name))
+			continue
+		}
+		delete(oldCapsules, cp.name)
+
+		added, removed := diffLines(ocp.hosts, cp.hosts)
+		for _, h := range added {
+			changes = append(changes, fmt.Sprintf("%s: added host %s", cp.name, h))
+		}
+		for _, h := range removed {
+			changes = append(changes, fmt.Sprintf("%s: removed host %s", cp.name, h))
+		}
+
+		added, removed = diffLines(mountLines(ocp.mounts), mountLines(cp.mounts))
+		for _, m := range added {
+			changes = append(changes, fmt.Sprintf("%s: added mount %s", cp.name, m))
+		}
+		for _, m := range removed {
+			changes = append(changes, fmt.Sprintf("%s: removed mount %s", cp.name, m))
+		}
+
+		if ocp.accountQuota != cp.accountQuota || ocp.capsuleQuota != cp.capsuleQuota {
+			changes = append(changes, fmt.Sprintf("%s: quotas changed", cp.name))
+		}
+
+		if ocp.backend.String() != cp.backend.String() {
+			changes = append(changes, fmt.Sprintf("%s: backend %s -> %s", cp.name, ocp.backend, cp.backend))
+		}
+
+		added, removed = diffLines(accessLines(ocp), accessLines(cp))
+		for _, a := range added {
+			changes = append(changes, fmt.Sprintf("%s: added access %s", cp.name, a))
+		}
+		for _, a := range removed {
+			changes = append(changes, fmt.Sprintf("%s: removed access %s", cp.name, a))
+		}
+
+		added, removed = diffLines(userLines(ocp), userLines(cp))
+		for _, u := range added {
+			changes = append(changes, fmt.Sprintf("%s: added user %s", cp.name, u))
+		}
+		for _, u := range removed {
+			changes = append(changes, fmt.Sprintf("%s: removed user %s", cp.name, u))
+		}
+
+		added, removed = diffLines(groupLines(ocp), groupLines(cp))
+		for _, g := range added {
+			changes = append(changes, fmt.Sprintf("%s: added group entry %s", cp.name, g))
+		}
+		for _, g := range removed {
+			changes = append(changes, fmt.Sprintf("%s: removed group entry %s", cp.name, g))
+		}
+
+		files := []string{}
+		for cf := range cp.commands {
+			files = append(files, cf)
+		}
+		for cf := range ocp.commands {
+			if _, ok := cp.commands[cf]; !ok {
+				files = append(files, cf)
+			}
+		}
+		sort.Strings(files)
+		for _, cf := range files {
+			added, removed := diffLines(templateLines(ocp.commands[cf]), templateLines(cp.commands[cf]))
+			for _, l := range added {
+				changes = append(changes, fmt.Sprintf("%s: %s: added command %q", cp.name, cf, l))
+			}
+			for _, l := range removed {
+				changes = append(changes, fmt.Sprintf("%s: %s: removed command %q", cp.name, cf, l))
+			}
+		}
+	}
+
+	for name := range oldCapsules {
+		changes = append(changes, fmt.Sprintf("%s: removed capsule", name))
+	}
+
+	return changes
+}
+
+// Load the policy again, keeping the current one if there are any errors
+func reloadPolicy() error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	p, err := loadPolicy()
+	metrics.policyLoaded(err)
+	if err != nil {
+		return err
+	}
+
+	changes := diffPolicy(getPolicy(), p)
+	currentPolicy.Store(p)
+
+	if len(changes) == 0 {
+		log.Printf("Policy reloaded with no changes\n")
+	}
+	for _, c := range changes {
+		log.Printf("Policy change: %s\n", c)
+	}
+
+	return nil
+}
+
+// Reload the policy on SIGHUP or when the files change
+func watchPolicy(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+
+	// Files that failed to load are only retried after they change again
+	seen := getPolicy().signature
+	for {
+		select {
+		case <-hup:
+			log.Printf("Reloading policy on SIGHUP\n")
+		case <-tick:
+			// The policy may have been reloaded already, such as after
+			//  an invite was redeemed.
+			sig := policySignature(getPolicy().files)
+			if sig == seen || sig == getPolicy().signature {
+				seen = sig
+				continue
+			}
+			seen = sig
+			log.Printf("Reloading policy after file changes\n")
+		}
+
+		if err := reloadPolicy(); err != nil {
+			log.Printf("ERROR: keeping the current policy: %s\n", err)
+		} else {
+			seen = getPolicy().signature
+		}
+	}
+}
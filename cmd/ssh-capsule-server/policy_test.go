@@ -0,0 +1,125 @@
+package main
+
+import (
+	gossh "golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Write the files of a capsule, creating its directory
+func writeCapsule(t *testing.T, dir string, files map[string]string) string {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for f, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadCapsulePolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	admin, other := testKey(t), testKey(t)
+	c := writeCapsule(t, filepath.Join(dir, "ok"), map[string]string{
+		"host":            "example.com\n\nother.example.com\n",
+		"group":           "# admins\n" + gossh.FingerprintSHA256(admin) + " admin\n" + gossh.FingerprintSHA256(other) + "\n",
+		"commands":        "# public\ntpl\ncat <path>\n",
+		"commands-admin":  "rm <path>\n",
+		"commands.backup": "bogus <bogus>\n",
+	})
+	cp, files, err := loadCapsulePolicy(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watched := strings.Join(files, " ")
+	if !strings.Contains(watched, filepath.Join(c, "commands-admin")) || strings.Contains(watched, "commands.backup") {
+		t.Errorf("watching %q", files)
+	}
+	if want := []string{"example.com", "other.example.com"}; !reflect.DeepEqual(cp.hosts, want) {
+		t.Errorf("hosts = %q, want %q", cp.hosts, want)
+	}
+	if es := cp.groups[accountName(admin)]; len(cp.groups) != 1 || len(es) != 1 || !reflect.DeepEqual(es[0].groups, []string{"admin"}) {
+		t.Errorf("groups = %v", cp.groups)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	if got := templateLines(cp.forClient(accountName(admin), addr).templates()); !reflect.DeepEqual(got, []string{"tpl", "cat <path>", "rm <path>"}) {
+		t.Errorf("admin templates = %q", got)
+	}
+	if got := templateLines(cp.forClient(accountName(other), addr).templates()); !reflect.DeepEqual(got, []string{"tpl", "cat <path>"}) {
+		t.Errorf("public templates = %q", got)
+	}
+
+	bad := writeCapsule(t, filepath.Join(dir, "bad"), map[string]string{
+		"commands": "tpl\nls <bogus>\n",
+	})
+	if _, _, err := loadCapsulePolicy(bad); err == nil || !strings.Contains(err.Error(), "commands:2:") {
+		t.Errorf("a bad template gave %v, want an error with its line", err)
+	}
+
+	missing := writeCapsule(t, filepath.Join(dir, "missing"), map[string]string{
+		"host": "example.com\n",
+	})
+	if _, _, err := loadCapsulePolicy(missing); err == nil {
+		t.Errorf("a capsule without a commands file loaded")
+	}
+}
+
+func TestPolicyHostsAndChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	def := writeCapsule(t, filepath.Join(dir, "default"), map[string]string{
+		"commands": "tpl\n",
+	})
+	other := writeCapsule(t, filepath.Join(dir, "other"), map[string]string{
+		"host":     "example.com\n",
+		"commands": "tpl\n",
+	})
+	paths := []string{def, other}
+
+	old, err := loadDirPolicy(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp := old.capsuleForHost("example.com"); cp.path != other {
+		t.Errorf("example.com is served by %s", cp.path)
+	}
+	if cp := old.capsuleForHost("unknown.com"); cp.path != def {
+		t.Errorf("unknown.com is served by %s", cp.path)
+	}
+
+	writeCapsule(t, other, map[string]string{
+		"host":     "example.org\n",
+		"commands": "tpl\ncat <path>\n",
+	})
+	new, err := loadDirPolicy(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		other + ": added host example.org",
+		other + ": removed host example.com",
+		other + `: commands: added command "cat <path>"`,
+	}
+	if got := diffPolicy(old, new); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffPolicy = %q, want %q", got, want)
+	}
+	if got := diffPolicy(new, new); len(got) != 0 {
+		t.Errorf("diffPolicy of the same policy = %q", got)
+	}
+}
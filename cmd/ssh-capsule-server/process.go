@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// External commands run in their own process group so that the command and
+// anything it starts can be killed together. That happens when the client
+// disconnects or the command goes over one of its limits: the time it runs,
+// the bytes it writes to stdout and stderr or the bytes it reads from stdin.
+// Each limit has a server default that a template can change with options in
+// front of the command, where 0 is no limit:
+//
+// @runtime=10m @output=1G git-upload-pack <path>
+// @stdin=0 git-receive-pack <home-path>
+//
+
+const (
+	LIMIT_EXIT_STATUS = 124
+
+	// How long the output of a command is read after it exits if something
+	//  outside of its process group still holds it open
+	OUTPUT_DRAIN_TIMEOUT = time.Second
+)
+
+type processLimits struct {
+	runtime time.Duration
+	output  int64
+	stdin   int64
+}
+
+// Limits that aren't set are -1, so that 0 can turn off a default
+var unsetLimits = processLimits{-1, -1, -1}
+
+var defaultLimits = processLimits{}
+
+func parseTemplateOption(tok string, pl *processLimits) error {
+	parts := []string{tok, ""}
+	for i := range tok {
+		if tok[i] == '=' {
+			parts = []string{tok[1:i], tok[i+1:]}
+			break
+		}
+	}
+
+	var err error
+	switch parts[0] {
+	case "runtime":
+		pl.runtime, err = time.ParseDuration(parts[1])
+		if err == nil && pl.runtime < 0 {
+			err = fmt.Errorf("negative runtime")
+		}
+	case "output":
+		pl.output, err = parseSize(parts[1])
+	case "stdin":
+		pl.stdin, err = parseSize(parts[1])
+	default:
+		return fmt.Errorf("unknown option %q", tok)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid option %q: %s", tok, err)
+	}
+	return nil
+}
+
+// The template's limits, with the defaults for those that it doesn't set
+func (t *commandTemplate) processLimits() processLimits {
+	pl := t.limits
+	if pl.runtime < 0 {
+		pl.runtime = defaultLimits.runtime
+	}
+	if pl.output < 0 {
+		pl.output = defaultLimits.output
+	}
+	if pl.stdin < 0 {
+		pl.stdin = defaultLimits.stdin
+	}
+	return pl
+}
+
+type processLimitError struct {
+	limit string
+}
+
+func (e *processLimitError) Error() string {
+	return e.limit + " limit reached"
+}
+
+// A writer that stops the process once the output shared between stdout
+// and stderr reaches the limit.
+type outputLimit struct {
+	mutex   sync.Mutex
+	written int64
+	max     int64
+	stop    func(error)
+}
+
+type limitedWriter struct {
+	w  io.Writer
+	ol *outputLimit
+}
+
+func (lw limitedWriter) Write(b []byte) (int, error) {
+	ol := lw.ol
+	if ol.max > 0 {
+		ol.mutex.Lock()
+		left := ol.max - ol.written
+		if int64(len(b)) > left {
+			ol.written = ol.max
+			ol.mutex.Unlock()
+			if left > 0 {
+				lw.w.Write(b[:left])
+			}
+			ol.stop(&processLimitError{"output"})
+			return int(left), io.ErrShortWrite
+		}
+		ol.written += int64(len(b))
+		ol.mutex.Unlock()
+	}
+	return lw.w.Write(b)
+}
+
+// Run the command for the session in its own process group, returning
+// the exit code.
+func runProcess(s ssh.Session, c *exec.Cmd, pl processLimits, q *quotaTracker, quotaPaths []string) int {
+	name := filepath.Base(c.Args[0])
+	setProcessGroup(c)
+
+	var stopOnce sync.Once
+	var stopErr error
+	stop := func(err error) {
+		stopOnce.Do(func() {
+			stopErr = err
+			if c.Process != nil {
+				killProcessGroup(c)
+			}
+		})
+	}
+
+	// Stdin isn't given to exec since it would wait for the client to
+	//  close it before the command could finish.
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		log.Printf("ERROR: %s\n", err)
+		return 1
+	}
+
+	// The output is copied here rather than by exec, which waits for
+	//  anything the command started in the background to close it too.
+	ol := &outputLimit{max: pl.output, stop: stop}
+	outputs := []*outputPipe{}
+	for _, o := range []struct {
+		w  io.Writer
+		to *io.Writer
+	}{
+		{s, &c.Stdout},
+		{s.Stderr(), &c.Stderr},
+	} {
+		op, err := newOutputPipe(limitedWriter{o.w, ol})
+		if err != nil {
+			log.Printf("ERROR: %s\n", err)
+			return 1
+		}
+		defer op.r.Close()
+		*o.to = op.w
+		outputs = append(outputs, op)
+	}
+
+	err = c.Start()
+	for _, op := range outputs {
+		op.w.Close()
+	}
+	if err != nil {
+		log.Printf("ERROR: %s\n", err)
+		fmt.Fprintf(s.Stderr(), "%s: Command not found\n", name)
+		return 127
+	}
+	for _, op := range outputs {
+		go op.copy()
+	}
+	running.add(c, stop)
+	defer running.remove(c)
+
+	go func() {
+		defer stdin.Close()
+		r := io.Reader(s)
+		if pl.stdin > 0 {
+			r = io.LimitReader(s, pl.stdin+1)
+		}
+		n, _ := io.Copy(stdin, r)
+		if pl.stdin > 0 && n > pl.stdin {
+			stop(&processLimitError{"stdin"})
+		}
+	}()
+
+	finished := make(chan struct{})
+	if pl.runtime > 0 {
+		t := time.AfterFunc(pl.runtime, func() {
+			stop(&processLimitError{"runtime"})
+		})
+		defer t.Stop()
+	}
+	go func() {
+		select {
+		case <-s.Context().Done():
+			stop(fmt.Errorf("client disconnected"))
+		case <-finished:
+		}
+	}()
+
+	// The command is stopped if what it writes goes over a quota
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		q.watch(quotaPaths, finished, stop)
+	}()
+
+	err = c.Wait()
+
+	// Anything the command left running in its group is stopped too so
+	//  that the rest of the output can be read.
+	stop(nil)
+	drain := time.NewTimer(OUTPUT_DRAIN_TIMEOUT)
+	for _, op := range outputs {
+		select {
+		case <-op.done:
+		case <-drain.C:
+			log.Printf("ERROR: %s: output is still open after it exited\n", name)
+			for _, op := range outputs {
+				op.r.Close()
+				<-op.done
+			}
+		}
+	}
+	drain.Stop()
+
+	close(finished)
+	<-watched
+	switch e := stopErr.(type) {
+	case nil:
+	case *quotaError:
+		log.Printf("ERROR: %s: %s\n", name, e)
+		fmt.Fprintf(s.Stderr(), "%s: %s\n", name, e)
+		return QUOTA_EXIT_STATUS
+	case *processLimitError:
+		log.Printf("ERROR: %s: %s\n", name, e)
+		fmt.Fprintf(s.Stderr(), "%s: %s\n", name, e)
+		return LIMIT_EXIT_STATUS
+	default:
+		log.Printf("Stopped %s: %s\n", name, e)
+	}
+
+	if err != nil {
+		log.Printf("ERROR: %s\n", err)
+	}
+	if c.ProcessState == nil {
+		return 1
+	}
+	return exitStatus(c.ProcessState)
+}
+
+// A pipe for the output of a command that is copied to the client
+type outputPipe struct {
+	r    *os.File
+	w    *os.File
+	to   io.Writer
+	done chan struct{}
+}
+
+func newOutputPipe(to io.Writer) (*outputPipe, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	return &outputPipe{r: r, w: w, to: to, done: make(chan struct{})}, nil
+}
+
+func (op *outputPipe) copy() {
+	defer close(op.done)
+	io.Copy(op.to, op.r)
+}
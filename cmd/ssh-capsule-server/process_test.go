@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/gliderlabs/ssh"
+	"io"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A session with only what runProcess uses
+type processSession struct {
+	ssh.Session
+	stdin  io.Reader
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+}
+
+func newProcessSession(stdin string) *processSession {
+	return &processSession{stdin: strings.NewReader(stdin)}
+}
+
+func (s *processSession) Read(b []byte) (int, error)  { return s.stdin.Read(b) }
+func (s *processSession) Write(b []byte) (int, error) { return s.stdout.Write(b) }
+func (s *processSession) Stderr() io.ReadWriter       { return &s.stderr }
+func (s *processSession) Context() context.Context    { return context.Background() }
+
+func TestParseTemplateOption(t *testing.T) {
+	tests := []struct {
+		tok  string
+		want processLimits
+		ok   bool
+	}{
+		{"@runtime=10m", processLimits{10 * time.Minute, -1, -1}, true},
+		{"@output=1G", processLimits{-1, 1 << 30, -1}, true},
+		{"@stdin=0", processLimits{-1, -1, 0}, true},
+		{"@runtime=-1s", processLimits{}, false},
+		{"@runtime", processLimits{}, false},
+		{"@output=lots", processLimits{}, false},
+		{"@nice=10", processLimits{}, false},
+	}
+
+	for _, tt := range tests {
+		pl := unsetLimits
+		err := parseTemplateOption(tt.tok, &pl)
+		if tt.ok && (err != nil || pl != tt.want) {
+			t.Errorf("parseTemplateOption(%q) = %v, %v, want %v", tt.tok, pl, err, tt.want)
+		} else if !tt.ok && err == nil {
+			t.Errorf("parseTemplateOption(%q) succeeded, want an error", tt.tok)
+		}
+	}
+
+	defer func(pl processLimits) { defaultLimits = pl }(defaultLimits)
+	defaultLimits = processLimits{time.Minute, 100, 200}
+	ct := &commandTemplate{limits: processLimits{-1, 0, -1}}
+	if pl := ct.processLimits(); pl != (processLimits{time.Minute, 0, 200}) {
+		t.Errorf("processLimits() = %v", pl)
+	}
+}
+
+func TestLimitedWriter(t *testing.T) {
+	var stopped error
+	var out bytes.Buffer
+	ol := &outputLimit{max: 5, stop: func(err error) { stopped = err }}
+	stdout, stderr := limitedWriter{&out, ol}, limitedWriter{&out, ol}
+
+	if n, err := stdout.Write([]byte("abc")); n != 3 || err != nil || stopped != nil {
+		t.Errorf("a write under the limit gave %d, %v", n, err)
+	}
+	if n, err := stderr.Write([]byte("defg")); n != 2 || err == nil {
+		t.Errorf("a write over the limit gave %d, %v", n, err)
+	}
+	if _, ok := stopped.(*processLimitError); !ok || out.String() != "abcde" {
+		t.Errorf("wrote %q and stopped with %v", out.String(), stopped)
+	}
+}
+
+func TestRunProcess(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands need a Unix shell")
+	}
+
+	s := newProcessSession("input\n")
+	if code := runProcess(s, exec.Command("sh", "-c", "cat; echo error >&2; exit 3"), processLimits{}, nil, nil); code != 3 {
+		t.Errorf("exit status %d, want 3", code)
+	}
+	if s.stdout.String() != "input\n" || s.stderr.String() != "error\n" {
+		t.Errorf("stdout %q, stderr %q", s.stdout.String(), s.stderr.String())
+	}
+
+	// A command killed by a signal exits like it would in a shell
+	s = newProcessSession("")
+	if code := runProcess(s, exec.Command("sh", "-c", "kill -TERM $$"), processLimits{}, nil, nil); code != 128+15 {
+		t.Errorf("a signalled command gave exit status %d, want 143", code)
+	}
+
+	// Something left running in the background doesn't keep the session
+	//  open, even though it holds stdout.
+	s = newProcessSession("")
+	start := time.Now()
+	if code := runProcess(s, exec.Command("sh", "-c", "sleep 30 & echo started"), processLimits{}, nil, nil); code != 0 {
+		t.Errorf("exit status %d, want 0", code)
+	}
+	if d := time.Since(start); d > 10*time.Second || s.stdout.String() != "started\n" {
+		t.Errorf("took %s and wrote %q", d, s.stdout.String())
+	}
+
+	s = newProcessSession("")
+	pl := processLimits{runtime: 100 * time.Millisecond}
+	if code := runProcess(s, exec.Command("sleep", "30"), pl, nil, nil); code != LIMIT_EXIT_STATUS {
+		t.Errorf("a command over its runtime gave %d", code)
+	}
+	if !strings.Contains(s.stderr.String(), "runtime limit reached") {
+		t.Errorf("stderr %q", s.stderr.String())
+	}
+
+	s = newProcessSession("")
+	pl = processLimits{output: 10}
+	if code := runProcess(s, exec.Command("sh", "-c", "while :; do echo y; done"), pl, nil, nil); code != LIMIT_EXIT_STATUS {
+		t.Errorf("a command over its output gave %d", code)
+	}
+	if s.stdout.String() != strings.Repeat("y\n", 5) {
+		t.Errorf("stdout %q", s.stdout.String())
+	}
+
+	s = newProcessSession(strings.Repeat("x", 100))
+	pl = processLimits{stdin: 10}
+	if code := runProcess(s, exec.Command("sh", "-c", "cat >/dev/null; sleep 30"), pl, nil, nil); code != LIMIT_EXIT_STATUS {
+		t.Errorf("a command over its stdin gave %d", code)
+	}
+}
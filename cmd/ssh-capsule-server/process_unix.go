@@ -0,0 +1,46 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(c *exec.Cmd) {
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.Setpgid = true
+}
+
+func setCredential(c *exec.Cmd, cred *credential) error {
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    cred.uid,
+		Gid:    cred.gid,
+		Groups: cred.groups,
+	}
+	return nil
+}
+
+func killProcessGroup(c *exec.Cmd) {
+	syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+}
+
+// The exit status a shell would give, which is 128 plus the signal for
+// commands that were killed by one.
+func exitStatus(ps *os.ProcessState) int {
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ps.ExitCode()
+}
+
+func terminateProcessGroup(c *exec.Cmd) {
+	syscall.Kill(-c.Process.Pid, syscall.SIGTERM)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Windows has no process groups that can be killed together, so only the
+// command itself is stopped.
+
+func setProcessGroup(c *exec.Cmd) {
+}
+
+func setCredential(c *exec.Cmd, cred *credential) error {
+	return fmt.Errorf("commands can't run as another user on Windows")
+}
+
+func killProcessGroup(c *exec.Cmd) {
+	c.Process.Kill()
+}
+
+func exitStatus(ps *os.ProcessState) int {
+	return ps.ExitCode()
+}
+
+// There are no signals to ask a command to exit
+func terminateProcessGroup(c *exec.Cmd) {
+	c.Process.Kill()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Behind a TCP load balancer every connection comes from the balancer. With
+// --proxy-trusted the connections from those networks must start with a
+// PROXY protocol header, version 1 or 2, with the address of the real client.
+// That address is then used for logging, rate limits and access lists.
+// Connections from other addresses are taken as they are.
+
+const PROXY_HEADER_TIMEOUT = 5 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	conn, err := pl.Listener.Accept()
+	if err != nil || !containsAddr(pl.trusted, conn.RemoteAddr()) {
+		return conn, err
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// A connection from a proxy. The header is read the first time the
+// connection is used, outside of the listener's accept loop.
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+func (pc *proxyConn) readHeader() {
+	pc.once.Do(func() {
+		pc.remote = pc.Conn.RemoteAddr()
+		pc.Conn.SetReadDeadline(time.Now().Add(PROXY_HEADER_TIMEOUT))
+		addr, err := readProxyHeader(pc.r)
+		pc.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			log.Printf("ERROR: PROXY header from %s: %s\n", pc.remote, err)
+			pc.err = err
+			pc.Conn.Close()
+			return
+		}
+		if addr != nil {
+			pc.remote = addr
+		}
+	})
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	pc.readHeader()
+	if pc.err != nil {
+		return 0, pc.err
+	}
+	return pc.r.Read(b)
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	pc.readHeader()
+	return pc.remote
+}
+
+// Read a PROXY header, returning the client's address or nil if the proxy
+// sent the connection on its own behalf.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if p, err := r.Peek(6); err == nil && string(p) == "PROXY " {
+		return readProxyV1(r)
+	}
+	return nil, fmt.Errorf("missing header")
+}
+
+// PROXY TCP4 192.0.2.1 198.51.100.1 50312 1966\r\n
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line := []byte{}
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("invalid version 1 header")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid version 1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid version 1 address")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unknown version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	// A LOCAL command, such as a health check from the proxy itself
+	if hdr[12]&0xf == 0 {
+		return nil, nil
+	}
+	if hdr[12]&0xf != 1 {
+		return nil, fmt.Errorf("unknown command %d", hdr[12]&0xf)
+	}
+
+	switch hdr[13] {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short IPv4 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short IPv6 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+
+	// Other families, such as Unix sockets, have no address to use
+	return nil, nil
+}
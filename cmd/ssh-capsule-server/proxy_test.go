@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func proxyV2(command byte, family byte, body []byte) string {
+	hdr := append([]byte{}, proxyV2Signature...)
+	hdr = append(hdr, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:16], uint16(len(body)))
+	return string(append(hdr, body...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xc4, 0x88, 0x07, 0xae}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1"))
+	copy(v6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(v6[32:], 50312)
+	binary.BigEndian.PutUint16(v6[34:], 1966)
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+		ok     bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.1 50312 1966\r\n", "192.0.2.1:50312", true},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 50312 1966\r\n", "[2001:db8::1]:50312", true},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", true},
+		{"v1 unknown with addresses", "PROXY UNKNOWN 192.0.2.1 198.51.100.1 50312 1966\r\n", "", true},
+		{"v1 no cr", "PROXY TCP4 192.0.2.1 198.51.100.1 50312 1966\n", "", false},
+		{"v1 udp", "PROXY UDP4 192.0.2.1 198.51.100.1 50312 1966\r\n", "", false},
+		{"v1 missing port", "PROXY TCP4 192.0.2.1 198.51.100.1 50312\r\n", "", false},
+		{"v1 bad address", "PROXY TCP4 192.0.2 198.51.100.1 50312 1966\r\n", "", false},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 198.51.100.1 70000 1966\r\n", "", false},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", false},
+		{"v1 truncated", "PROXY TCP4 192.0.2.1", "", false},
+		{"v2 tcp4", proxyV2(1, 0x11, v4), "192.0.2.1:50312", true},
+		{"v2 tcp4 with tlvs", proxyV2(1, 0x11, append(append([]byte{}, v4...), 0x04, 0, 1, 'x')), "192.0.2.1:50312", true},
+		{"v2 tcp6", proxyV2(1, 0x21, v6), "[2001:db8::1]:50312", true},
+		{"v2 local", proxyV2(0, 0x00, nil), "", true},
+		{"v2 unix", proxyV2(1, 0x31, make([]byte, 216)), "", true},
+		{"v2 short ipv4", proxyV2(1, 0x11, v4[:8]), "", false},
+		{"v2 short ipv6", proxyV2(1, 0x21, v6[:20]), "", false},
+		{"v2 bad command", proxyV2(2, 0x11, v4), "", false},
+		{"v2 bad version", strings.Replace(proxyV2(1, 0x11, v4), "\x21\x11", "\x11\x11", 1), "", false},
+		{"v2 truncated", proxyV2(1, 0x11, v4)[:20], "", false},
+		{"none", "SSH-2.0-OpenSSH_8.9\r\n", "", false},
+		{"empty", "", "", false},
+	}
+
+	for _, tt := range tests {
+		data := tt.header
+		if tt.ok {
+			data += "SSH-2.0-client\r\n"
+		}
+		r := bufio.NewReader(strings.NewReader(data))
+		addr, err := readProxyHeader(r)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: got %v, want an error", tt.name, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+
+		// The connection carries on right after the header
+		rest, _ := ioutil.ReadAll(r)
+		if string(rest) != "SSH-2.0-client\r\n" {
+			t.Errorf("%s: %q is left after the header", tt.name, rest)
+		}
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	nets, err := parseNetworks([]string{"10.0.0.0/8", "192.0.2.7", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.1.2.3:22", true},
+		{"192.0.2.7:22", true},
+		{"192.0.2.8:22", false},
+		{"[2001:db8::5]:22", true},
+		{"[2001:db9::5]:22", false},
+		{"[::ffff:10.1.2.3]:22", true},
+	}
+	for _, tt := range tests {
+		addr, err := net.ResolveTCPAddr("tcp", tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := containsAddr(nets, addr); got != tt.want {
+			t.Errorf("containsAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	for _, n := range []string{"10.0.0.0/33", "example.com", ""} {
+		if _, err := parseNetworks([]string{n}); err == nil {
+			t.Errorf("parseNetworks(%q) succeeded, want an error", n)
+		}
+	}
+}
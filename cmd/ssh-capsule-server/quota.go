@@ -0,0 +1,474 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quotas limit the bytes and number of files that can be stored, both for
+// each account and for the capsule as a whole. The capsule's usage is
+// everything in its writable mounts and account homes. An account's usage is
+// its home directory plus what it has uploaded elsewhere, which is kept in a
+// <account>.usage file next to the home. They are set in the quota file of
+// the capsule directory, where zero or a missing line means no limit:
+//
+// account 10M 1000
+// capsule 1G
+//
+// Writes are checked while they happen and a session that goes over a quota
+// is stopped with QUOTA_EXIT_STATUS. Removing files and making them smaller
+// gives the space back.
+
+const (
+	QUOTA_EXIT_STATUS   = 122 // EDQUOT
+	QUOTA_POLL_INTERVAL = time.Second
+)
+
+type quota struct {
+	bytes int64
+	files int64
+}
+
+type usage struct {
+	bytes int64
+	files int64
+}
+
+type quotaError struct {
+	scope string
+	limit string
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("%s quota of %s exceeded", e.scope, e.limit)
+}
+
+// Parse a size in bytes with an optional K, M, G or T suffix
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	mult := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	case "T":
+		mult = 1 << 40
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+func readQuota(capsulePath string) (quota, quota, error) {
+	var account, capsule quota
+
+	qf := filepath.Join(capsulePath, "quota")
+	lines, err := readLines(qf)
+	if os.IsNotExist(err) {
+		return account, capsule, nil
+	} else if err != nil {
+		return account, capsule, err
+	}
+
+	for i, l := range lines {
+		if len(strings.TrimSpace(l)) == 0 || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		fields := strings.Fields(l)
+		if len(fields) < 2 || len(fields) > 3 {
+			return account, capsule, fmt.Errorf("%s:%d: invalid quota %q", qf, i+1, l)
+		}
+
+		q := quota{}
+		if q.bytes, err = parseSize(fields[1]); err != nil {
+			return account, capsule, fmt.Errorf("%s:%d: %s", qf, i+1, err)
+		}
+		if len(fields) == 3 {
+			if q.files, err = strconv.ParseInt(fields[2], 10, 64); err != nil || q.files < 0 {
+				return account, capsule, fmt.Errorf("%s:%d: invalid file count %q", qf, i+1, fields[2])
+			}
+		}
+
+		switch fields[0] {
+		case "account":
+			account = q
+		case "capsule":
+			capsule = q
+		default:
+			return account, capsule, fmt.Errorf("%s:%d: unknown quota %q", qf, i+1, fields[0])
+		}
+	}
+
+	return account, capsule, nil
+}
+
+// The bytes and number of files and directories inside of the directories,
+// counting directories inside of others only once.
+func diskUsage(dirs []string) usage {
+	dirs = append([]string{}, dirs...)
+	sort.Strings(dirs)
+
+	u := usage{}
+	counted := []string{}
+	for _, d := range dirs {
+		nested := false
+		for _, c := range counted {
+			if within(d, c) {
+				nested = true
+			}
+		}
+		if nested {
+			continue
+		}
+		counted = append(counted, d)
+
+		filepath.Walk(d, func(p string, info os.FileInfo, err error) error {
+			if err != nil || p == d {
+				return nil
+			}
+			u.files++
+			if info.Mode().IsRegular() {
+				u.bytes += info.Size()
+			}
+			return nil
+		})
+	}
+
+	return u
+}
+
+// The directories that count towards the capsule's usage
+func (cp *capsulePolicy) writableDirs() []string {
+	dirs := []string{}
+	for _, m := range cp.mounts {
+		if !m.readOnly && m.virtual != "~" {
+			dirs = append(dirs, m.real)
+		}
+	}
+	if cp.homes != "" {
+		dirs = append(dirs, realDir(cp.homes))
+	}
+	return dirs
+}
+
+func (cp *capsulePolicy) ledgerFile(account string) string {
+	if cp.homes == "" {
+		return ""
+	}
+	return filepath.Join(realDir(cp.homes), account+".usage")
+}
+
+func readLedger(ledger string) usage {
+	u := usage{}
+	if ledger == "" {
+		return u
+	}
+	b, err := ioutil.ReadFile(ledger)
+	if err != nil {
+		return u
+	}
+	fmt.Sscanf(string(b), "%d %d", &u.bytes, &u.files)
+	return u
+}
+
+type quotaScope struct {
+	name  string
+	key   string
+	limit quota
+	used  usage
+}
+
+// Writes by the active sessions that may not be counted on disk yet
+var (
+	quotaMutex   sync.Mutex
+	quotaPending = map[string]usage{}
+)
+
+// The quotas of one session, a nil tracker has no limits. The sftp server
+// handles requests concurrently so the mutex guards the rest of it.
+type quotaTracker struct {
+	cp      *capsulePolicy
+	account string
+	ledger  string
+
+	mutex    sync.Mutex
+	scopes   []*quotaScope
+	loaded   bool
+	charged  usage
+	outside  usage
+	exceeded bool
+}
+
+func (cp *capsulePolicy) hasQuota() bool {
+	return cp.accountQuota != (quota{}) || cp.capsuleQuota != (quota{})
+}
+
+func (cp *capsulePolicy) accountUsage(account string) usage {
+	u := readLedger(cp.ledgerFile(account))
+	if cp.home != "" {
+		hu := diskUsage([]string{cp.home})
+		u.bytes += hu.bytes
+		u.files += hu.files
+	}
+	return u
+}
+
+// Track the writes of a session of the account against its quotas
+func (cp *capsulePolicy) startQuota(account string) *quotaTracker {
+	if !cp.hasQuota() {
+		return nil
+	}
+	return &quotaTracker{cp: cp, account: account, ledger: cp.ledgerFile(account)}
+}
+
+// The usage on disk is only measured once the session writes something
+func (t *quotaTracker) load() {
+	t.loaded = true
+	if t.cp.accountQuota != (quota{}) {
+		t.scopes = append(t.scopes, &quotaScope{"account", t.cp.name + " " + t.account, t.cp.accountQuota, t.cp.accountUsage(t.account)})
+	}
+	if t.cp.capsuleQuota != (quota{}) {
+		t.scopes = append(t.scopes, &quotaScope{"capsule", t.cp.name, t.cp.capsuleQuota, diskUsage(t.cp.writableDirs())})
+	}
+}
+
+// Count new data written to the physical path p, or return a quotaError
+// if it would go over one of the quotas.
+func (t *quotaTracker) charge(p string, u usage) error {
+	if t == nil || (u.bytes <= 0 && u.files <= 0) {
+		return nil
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.loaded {
+		t.load()
+	}
+
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+
+	for _, s := range t.scopes {
+		pending := quotaPending[s.key]
+		if s.limit.bytes > 0 && s.used.bytes+pending.bytes+u.bytes > s.limit.bytes {
+			t.exceeded = true
+			return &quotaError{s.name, fmt.Sprintf("%d bytes", s.limit.bytes)}
+		}
+		if s.limit.files > 0 && s.used.files+pending.files+u.files > s.limit.files {
+			t.exceeded = true
+			return &quotaError{s.name, fmt.Sprintf("%d files", s.limit.files)}
+		}
+	}
+
+	for _, s := range t.scopes {
+		pending := quotaPending[s.key]
+		pending.bytes += u.bytes
+		pending.files += u.files
+		quotaPending[s.key] = pending
+	}
+	t.charged.bytes += u.bytes
+	t.charged.files += u.files
+
+	// Writes to the home are counted from the disk, others are kept in
+	//  the account's ledger.
+	if t.cp.home == "" || !within(p, t.cp.home) {
+		t.outside.bytes += u.bytes
+		t.outside.files += u.files
+	}
+
+	return nil
+}
+
+// What an existing file or directory counts for
+func fileUsage(info os.FileInfo) usage {
+	if info.Mode().IsRegular() {
+		return usage{info.Size(), 1}
+	}
+	return usage{0, 1}
+}
+
+// Give back the space of data removed from the physical path p. Other
+// sessions see it the next time they measure the disk.
+func (t *quotaTracker) release(p string, u usage) {
+	if t == nil || (u.bytes <= 0 && u.files <= 0) {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, s := range t.scopes {
+		s.used.bytes -= u.bytes
+		s.used.files -= u.files
+	}
+	if t.cp.home == "" || !within(p, t.cp.home) {
+		t.outside.bytes -= u.bytes
+		t.outside.files -= u.files
+	}
+}
+
+// Charge or give back the change in usage from before to after
+func (t *quotaTracker) change(p string, before usage, after usage) error {
+	grown := usage{after.bytes - before.bytes, after.files - before.files}
+	shrunk := usage{}
+	if grown.bytes < 0 {
+		shrunk.bytes, grown.bytes = -grown.bytes, 0
+	}
+	if grown.files < 0 {
+		shrunk.files, grown.files = -grown.files, 0
+	}
+	t.release(p, shrunk)
+	return t.charge(p, grown)
+}
+
+func (t *quotaTracker) overQuota() bool {
+	if t == nil {
+		return false
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.exceeded
+}
+
+// Record the session's writes once they have finished
+func (t *quotaTracker) finish() {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+
+	for _, s := range t.scopes {
+		pending := quotaPending[s.key]
+		pending.bytes -= t.charged.bytes
+		pending.files -= t.charged.files
+		if pending == (usage{}) {
+			delete(quotaPending, s.key)
+		} else {
+			quotaPending[s.key] = pending
+		}
+	}
+
+	if t.ledger != "" && t.outside != (usage{}) {
+		u := readLedger(t.ledger)
+		u.bytes += t.outside.bytes
+		u.files += t.outside.files
+		// The account may remove files that were there before the
+		//  ledger was kept or that someone else uploaded.
+		if u.bytes < 0 {
+			u.bytes = 0
+		}
+		if u.files < 0 {
+			u.files = 0
+		}
+		if err := os.MkdirAll(filepath.Dir(t.ledger), 0700); err != nil {
+			log.Printf("ERROR: %s\n", err)
+		} else if err := ioutil.WriteFile(t.ledger, []byte(fmt.Sprintf("%d %d\n", u.bytes, u.files)), 0600); err != nil {
+			log.Printf("ERROR: %s\n", err)
+		}
+	}
+}
+
+// The usage of the paths that an external command was given
+func pathsUsage(paths []string) usage {
+	u := diskUsage(paths)
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+			u.bytes += info.Size()
+		}
+	}
+	return u
+}
+
+// Watch the paths that an external command was given for changes, calling
+// stop if the command goes over a quota. Watching ends when done is closed.
+func (t *quotaTracker) watch(paths []string, done <-chan struct{}, stop func(error)) {
+	if t == nil || len(paths) == 0 {
+		return
+	}
+
+	last := pathsUsage(paths)
+	check := func() error {
+		now := pathsUsage(paths)
+		err := t.change(paths[0], last, now)
+		last = now
+		return err
+	}
+
+	tick := time.NewTicker(QUOTA_POLL_INTERVAL)
+	defer tick.Stop()
+	for {
+		select {
+		case <-done:
+			check()
+			return
+		case <-tick.C:
+			if err := check(); err != nil {
+				stop(err)
+				return
+			}
+		}
+	}
+}
+
+// A file that charges the quota as it grows
+type quotaFile struct {
+	*os.File
+	q     *quotaTracker
+	mutex sync.Mutex
+	size  int64
+}
+
+func (f *quotaFile) WriteAt(b []byte, off int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if end := off + int64(len(b)); end > f.size {
+		if err := f.q.charge(f.Name(), usage{end - f.size, 0}); err != nil {
+			return 0, err
+		}
+		f.size = end
+	}
+	return f.File.WriteAt(b, off)
+}
+
+func formatLimit(used int64, limit int64, unit string) string {
+	if limit == 0 {
+		return fmt.Sprintf("%d %s (no limit)", used, unit)
+	}
+	return fmt.Sprintf("%d of %d %s", used, limit, unit)
+}
+
+// Show the visitor their usage and quotas
+func quotaCommand(stdout io.Writer, cp *capsulePolicy, account string) int {
+	au := cp.accountUsage(account)
+	cu := diskUsage(cp.writableDirs())
+
+	fmt.Fprintf(stdout, "account: %s, %s\n", formatLimit(au.bytes, cp.accountQuota.bytes, "bytes"), formatLimit(au.files, cp.accountQuota.files, "files"))
+	fmt.Fprintf(stdout, "capsule: %s, %s\n", formatLimit(cu.bytes, cp.capsuleQuota.bytes, "bytes"), formatLimit(cu.files, cp.capsuleQuota.files, "files"))
+	return 0
+}
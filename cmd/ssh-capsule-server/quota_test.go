@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/pkg/sftp"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func quotaCapsule(t *testing.T, account quota, capsule quota) (string, *capsulePolicy) {
+	dir, err := ioutil.TempDir("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir = realDir(dir)
+	for _, d := range []string{"content", "homes"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cp := &capsulePolicy{name: "test", content: filepath.Join(dir, "content"), homes: filepath.Join(dir, "homes"), accountQuota: account, capsuleQuota: capsule}
+	if err := cp.setMounts(nil); err != nil {
+		t.Fatal(err)
+	}
+	return dir, cp
+}
+
+// Space that is given back can be used again, in the same session and in
+// the next ones.
+func TestQuotaRelease(t *testing.T) {
+	dir, cp := quotaCapsule(t, quota{10, 2}, quota{})
+	defer os.RemoveAll(dir)
+	p := filepath.Join(cp.content, "f")
+
+	q := cp.startQuota("account")
+	if err := q.charge(p, usage{8, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.charge(p, usage{8, 1}); err == nil {
+		t.Fatal("went over the quota")
+	}
+	q.release(p, usage{8, 1})
+	if err := q.charge(p, usage{8, 1}); err != nil {
+		t.Fatalf("the released space can't be used: %s", err)
+	}
+	q.finish()
+
+	if u := readLedger(cp.ledgerFile("account")); u != (usage{8, 1}) {
+		t.Fatalf("the ledger has %v, want {8 1}", u)
+	}
+
+	q = cp.startQuota("account")
+	if err := q.change(p, usage{8, 1}, usage{2, 1}); err != nil {
+		t.Fatal(err)
+	}
+	q.release(p, usage{2, 1})
+	q.release(p, usage{5, 1})
+	q.finish()
+
+	if u := readLedger(cp.ledgerFile("account")); u != (usage{}) {
+		t.Fatalf("the ledger has %v after the file was removed, want none", u)
+	}
+
+	q = cp.startQuota("account")
+	if err := q.charge(p, usage{10, 2}); err != nil {
+		t.Fatalf("the removed file still counts: %s", err)
+	}
+	q.finish()
+}
+
+// Run with -race, the sftp server writes a file from several goroutines
+func TestQuotaFileConcurrent(t *testing.T) {
+	dir, cp := quotaCapsule(t, quota{}, quota{1 << 20, 0})
+	defer os.RemoveAll(dir)
+
+	f, err := os.Create(filepath.Join(cp.content, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	q := cp.startQuota("account")
+	qf := &quotaFile{File: f, q: q}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := qf.WriteAt(make([]byte, 1024), int64(i)*1024); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if q.charged.bytes != 8*1024 || q.overQuota() {
+		t.Errorf("charged %d bytes for an 8K file", q.charged.bytes)
+	}
+	q.finish()
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"100", 100, true},
+		{"10K", 10 << 10, true},
+		{"10m", 10 << 20, true},
+		{"1G", 1 << 30, true},
+		{"2T", 2 << 40, true},
+		{"", 0, false},
+		{"K", 0, false},
+		{"-1", 0, false},
+		{"1.5G", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSize(tt.s)
+		if tt.ok && (err != nil || got != tt.want) {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", tt.s, got, err, tt.want)
+		} else if !tt.ok && err == nil {
+			t.Errorf("parseSize(%q) = %d, want an error", tt.s, got)
+		}
+	}
+}
+
+// Writes that fail don't use up the quota
+func TestQuotaFailedWrites(t *testing.T) {
+	dir, cp := quotaCapsule(t, quota{0, 1}, quota{})
+	defer os.RemoveAll(dir)
+
+	q := cp.startQuota("account")
+	server, conn := net.Pipe()
+	go sftpCommand(server, cp, []sftpWritable{{path: "/"}}, q)
+	client, err := sftp.NewClientPipe(conn, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Mkdir("/missing/sub"); err == nil {
+		t.Errorf("made a directory in a missing one")
+	}
+	if _, err := client.OpenFile("/missing/f", os.O_WRONLY|os.O_CREATE); err == nil {
+		t.Errorf("created a file in a missing directory")
+	}
+	if err := client.Mkdir("/sub"); err != nil {
+		t.Errorf("the failed writes used the quota: %s", err)
+	}
+	if err := client.Mkdir("/other"); err == nil {
+		t.Errorf("went over the quota")
+	}
+
+	q.finish()
+
+	// A file that isn't received completely only counts for what was
+	//  written.
+	dir, cp = quotaCapsule(t, quota{100, 0}, quota{})
+	defer os.RemoveAll(dir)
+	q = cp.startQuota("account")
+	r := bufio.NewReader(strings.NewReader("C0644 5 f\nda"))
+	if err := scpSink(r, &bytes.Buffer{}, scpOptions{sink: true}, cp.content, cp, q); err == nil {
+		t.Errorf("a partial upload succeeded")
+	}
+	q.finish()
+	if u := readLedger(cp.ledgerFile("account")); u != (usage{2, 1}) {
+		t.Errorf("a partial upload of 2 bytes left %v in the ledger", u)
+	}
+}
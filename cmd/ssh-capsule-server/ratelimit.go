@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Connections and commands are limited with token buckets, one for each key
+// fingerprint and one for each client network (the address with the
+// --ipv4-prefix or --ipv6-prefix). A rate like 20/1m allows a burst of 20
+// that refills over a minute. Clients that go over a limit are told to
+// "44 slow down", like the Gemini status, and the session ends with
+// SLOW_DOWN_EXIT_STATUS. Clients from the exempt networks have no limits.
+
+const (
+	SLOW_DOWN_EXIT_STATUS = 44
+	LIMITER_PRUNE_SIZE    = 10000
+)
+
+type rate struct {
+	burst float64
+	per   time.Duration
+}
+
+// Parse a rate such as 20/1m, 5/s or 100/24h. An empty rate is no limit.
+func parseRate(s string) (rate, error) {
+	r := rate{}
+	if s == "" {
+		return r, nil
+	}
+
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return r, fmt.Errorf("invalid rate %q, expected <count>/<duration>", s)
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n <= 0 {
+		return r, fmt.Errorf("invalid rate %q", s)
+	}
+	d := parts[1]
+	if d != "" && (d[0] < '0' || d[0] > '9') {
+		d = "1" + d
+	}
+	per, err := time.ParseDuration(d)
+	if err != nil || per <= 0 {
+		return r, fmt.Errorf("invalid rate %q", s)
+	}
+
+	return rate{float64(n), per}, nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type limiter struct {
+	mutex   sync.Mutex
+	r       rate
+	buckets map[string]*bucket
+}
+
+func newLimiter(r rate) *limiter {
+	if r.burst == 0 {
+		return nil
+	}
+	return &limiter{r: r, buckets: map[string]*bucket{}}
+}
+
+func (l *limiter) refill(b *bucket, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * l.r.burst / l.r.per.Seconds()
+	if b.tokens > l.r.burst {
+		b.tokens = l.r.burst
+	}
+	b.last = now
+}
+
+// Take a token for the key, returning how long until one is available if
+// there are none left. A nil limiter always allows.
+func (l *limiter) allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+
+	// Full buckets are the same as new ones, so they are forgotten
+	//  once there are many of them.
+	if len(l.buckets) > LIMITER_PRUNE_SIZE {
+		for k, b := range l.buckets {
+			l.refill(b, now)
+			if b.tokens >= l.r.burst {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.r.burst, last: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) * float64(l.r.per) / l.r.burst)
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+type rateLimits struct {
+	keyConnections     *limiter
+	keyCommands        *limiter
+	addressConnections *limiter
+	addressCommands    *limiter
+	ipv4Prefix         int
+	ipv6Prefix         int
+	exempt             []*net.IPNet
+
+	maxKeySessions int
+	sessionsMutex  sync.Mutex
+	sessions       map[string]int
+}
+
+type rateLimitConfig struct {
+	KeyConnections     string   `json:"key_connections"`
+	KeyCommands        string   `json:"key_commands"`
+	AddressConnections string   `json:"address_connections"`
+	AddressCommands    string   `json:"address_commands"`
+	MaxKeySessions     int      `json:"max_key_sessions"`
+	IPv4Prefix         *int     `json:"ipv4_prefix"`
+	IPv6Prefix         *int     `json:"ipv6_prefix"`
+	Exempt             []string `json:"exempt"`
+}
+
+var limits *rateLimits
+
+func newRateLimits(c rateLimitConfig) (*rateLimits, error) {
+	rl := &rateLimits{
+		ipv4Prefix:     32,
+		ipv6Prefix:     64,
+		maxKeySessions: c.MaxKeySessions,
+		sessions:       map[string]int{},
+	}
+	if c.IPv4Prefix != nil {
+		rl.ipv4Prefix = *c.IPv4Prefix
+	}
+	if c.IPv6Prefix != nil {
+		rl.ipv6Prefix = *c.IPv6Prefix
+	}
+
+	if rl.ipv4Prefix < 0 || rl.ipv4Prefix > 32 || rl.ipv6Prefix < 0 || rl.ipv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid network prefix length")
+	}
+
+	for _, l := range []struct {
+		r string
+		l **limiter
+	}{
+		{c.KeyConnections, &rl.keyConnections},
+		{c.KeyCommands, &rl.keyCommands},
+		{c.AddressConnections, &rl.addressConnections},
+		{c.AddressCommands, &rl.addressCommands},
+	} {
+		r, err := parseRate(l.r)
+		if err != nil {
+			return nil, err
+		}
+		*l.l = newLimiter(r)
+	}
+
+	exempt, err := parseNetworks(c.Exempt)
+	if err != nil {
+		return nil, err
+	}
+	rl.exempt = exempt
+
+	return rl, nil
+}
+
+// Parse networks in CIDR form or single addresses
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, n := range networks {
+		if !strings.Contains(n, "/") {
+			ip := net.ParseIP(n)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", n)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipn, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipn)
+	}
+	return nets, nil
+}
+
+func containsAddr(nets []*net.IPNet, addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The client's network, or an empty string if it has none, like a Unix socket
+func (rl *rateLimits) network(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// Unix sockets and other local connections
+		return ""
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(rl.ipv4Prefix, 32)), Mask: net.CIDRMask(rl.ipv4Prefix, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(rl.ipv6Prefix, 128)), Mask: net.CIDRMask(rl.ipv6Prefix, 128)}).String()
+}
+
+// The connection's limits are checked once, the first time it is used
+type connLimit struct {
+	once    sync.Once
+	network string
+	wait    time.Duration
+}
+
+type contextKey struct {
+	name string
+}
+
+var connLimitKey = &contextKey{"conn-limit"}
+
+// Count a new connection from the client's network
+func (rl *rateLimits) connCallback(ctx ssh.Context, conn net.Conn) net.Conn {
+	cl := &connLimit{network: rl.network(conn.RemoteAddr())}
+	if cl.network != "" && !containsAddr(rl.exempt, conn.RemoteAddr()) {
+		if ok, wait := rl.addressConnections.allow(cl.network); !ok {
+			cl.wait = wait
+		}
+	}
+	ctx.SetValue(connLimitKey, cl)
+	return conn
+}
+
+func (rl *rateLimits) addSession(account string) bool {
+	rl.sessionsMutex.Lock()
+	defer rl.sessionsMutex.Unlock()
+
+	if rl.maxKeySessions > 0 && rl.sessions[account] >= rl.maxKeySessions {
+		return false
+	}
+	rl.sessions[account]++
+	return true
+}
+
+func (rl *rateLimits) removeSession(account string) {
+	rl.sessionsMutex.Lock()
+	defer rl.sessionsMutex.Unlock()
+
+	rl.sessions[account]--
+	if rl.sessions[account] <= 0 {
+		delete(rl.sessions, account)
+	}
+}
+
+// Check the session against the limits, returning false and telling the
+// client to slow down if it is over one of them. Otherwise the returned
+// function must be called when the session ends.
+func (rl *rateLimits) start(s ssh.Session, account string) (func(), bool) {
+	if containsAddr(rl.exempt, s.RemoteAddr()) {
+		return func() {}, true
+	}
+
+	cl, _ := s.Context().Value(connLimitKey).(*connLimit)
+	if cl == nil {
+		cl = &connLimit{network: rl.network(s.RemoteAddr())}
+	}
+
+	// A connection that was over a limit stays that way
+	cl.once.Do(func() {
+		if ok, w := rl.keyConnections.allow(account); !ok && w > cl.wait {
+			cl.wait = w
+		}
+	})
+
+	// A session from a front-end server has the client's own address
+	wait := cl.wait
+	network := rl.network(s.RemoteAddr())
+	if ok, w := rl.keyCommands.allow(account); !ok && w > wait {
+		wait = w
+	}
+	if network != "" {
+		if ok, w := rl.addressCommands.allow(network); !ok && w > wait {
+			wait = w
+		}
+	}
+
+	if wait == 0 && !rl.addSession(account) {
+		log.Printf("Throttled: %s has %d sessions\n", account, rl.maxKeySessions)
+		io.WriteString(s.Stderr(), "44 slow down: too many sessions\n")
+		return nil, false
+	}
+	if wait > 0 {
+		secs := int(math.Ceil(wait.Seconds()))
+		log.Printf("Throttled: %s from %s for %ds\n", account, s.RemoteAddr(), secs)
+		fmt.Fprintf(s.Stderr(), "44 slow down: try again in %d seconds\n", secs)
+		return nil, false
+	}
+
+	return func() { rl.removeSession(account) }, true
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		s    string
+		want rate
+		ok   bool
+	}{
+		{"", rate{}, true},
+		{"20/1m", rate{20, time.Minute}, true},
+		{"5/s", rate{5, time.Second}, true},
+		{"100/24h", rate{100, 24 * time.Hour}, true},
+		{"20", rate{}, false},
+		{"0/1m", rate{}, false},
+		{"-1/1m", rate{}, false},
+		{"x/1m", rate{}, false},
+		{"20/", rate{}, false},
+		{"20/0s", rate{}, false},
+		{"20/fortnight", rate{}, false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseRate(tt.s)
+		if tt.ok && (err != nil || got != tt.want) {
+			t.Errorf("parseRate(%q) = %v, %v, want %v", tt.s, got, err, tt.want)
+		} else if !tt.ok && err == nil {
+			t.Errorf("parseRate(%q) = %v, want an error", tt.s, got)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	if ok, _ := newLimiter(rate{}).allow("a"); !ok {
+		t.Errorf("no rate limited a key")
+	}
+
+	l := newLimiter(rate{3, time.Hour})
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a"); !ok {
+			t.Fatalf("the burst ended after %d", i)
+		}
+	}
+	ok, wait := l.allow("a")
+	if ok || wait <= 0 || wait > 20*time.Minute {
+		t.Errorf("an empty bucket gave %v, %s", ok, wait)
+	}
+	if ok, _ := l.allow("b"); !ok {
+		t.Errorf("another key shares the bucket")
+	}
+
+	// A third of an hour refills a token
+	l.buckets["a"].last = l.buckets["a"].last.Add(-21 * time.Minute)
+	if ok, _ := l.allow("a"); !ok {
+		t.Errorf("the bucket didn't refill")
+	}
+	if ok, _ := l.allow("a"); ok {
+		t.Errorf("the bucket refilled too much")
+	}
+}
+
+func TestRateLimitNetworks(t *testing.T) {
+	v4, v6 := 24, 48
+	rl, err := newRateLimits(rateLimitConfig{IPv4Prefix: &v4, IPv6Prefix: &v6, Exempt: []string{"10.0.0.0/8", "192.0.2.1", "::1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr    net.Addr
+		network string
+		exempt  bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 22}, "198.51.100.0/24", false},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8:1:2::7"), Port: 22}, "2001:db8:1::/48", false},
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 22}, "10.1.2.0/24", true},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}, "192.0.2.0/24", true},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 22}, "192.0.2.0/24", false},
+		{&net.TCPAddr{IP: net.ParseIP("::1"), Port: 22}, "::/48", true},
+		{&net.UnixAddr{Name: "/run/capsule.sock", Net: "unix"}, "", false},
+	}
+
+	for _, tt := range tests {
+		if n := rl.network(tt.addr); n != tt.network {
+			t.Errorf("network(%s) = %q, want %q", tt.addr, n, tt.network)
+		}
+		if e := containsAddr(rl.exempt, tt.addr); e != tt.exempt {
+			t.Errorf("%s exempt = %v, want %v", tt.addr, e, tt.exempt)
+		}
+	}
+
+	for _, c := range []rateLimitConfig{
+		{Exempt: []string{"10.0.0.0/33"}},
+		{Exempt: []string{"example.com"}},
+		{KeyCommands: "often"},
+		{IPv4Prefix: &v6},
+	} {
+		if _, err := newRateLimits(c); err == nil {
+			t.Errorf("newRateLimits(%+v) succeeded, want an error", c)
+		}
+	}
+}
+
+func TestKeySessions(t *testing.T) {
+	rl, err := newRateLimits(rateLimitConfig{MaxKeySessions: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !rl.addSession("a") || !rl.addSession("a") {
+		t.Fatalf("the first sessions weren't allowed")
+	}
+	if rl.addSession("a") {
+		t.Errorf("a third session was allowed")
+	}
+	if !rl.addSession("b") {
+		t.Errorf("another key's session wasn't allowed")
+	}
+	rl.removeSession("a")
+	if !rl.addSession("a") {
+		t.Errorf("a session wasn't allowed after one ended")
+	}
+	rl.removeSession("b")
+	if _, ok := rl.sessions["b"]; ok {
+		t.Errorf("a key without sessions is still counted")
+	}
+}
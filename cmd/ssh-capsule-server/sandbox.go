@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"sort"
+)
+
+// With --sandbox each external command is started in new Linux user, mount,
+// PID, IPC and network namespaces. The server runs itself again inside of
+// them as SANDBOX_INIT, which builds an empty root filesystem with only the
+// capsule's mounts, its bin directory and the --sandbox-path system
+// directories bound read-only before running the command. The account's home
+// is the only writable directory and only when the template uses it, even
+// writable mounts are read-only here. There is no network and the command
+// can't see any other processes or capsules. SANDBOX_INIT stays as the PID 1
+// of the namespace, which ignores signals it doesn't handle, to pass them on.
+
+const SANDBOX_INIT = "capsule-sandbox-init"
+
+var DEFAULT_SANDBOX_PATHS = []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/etc"}
+
+type sandboxBind struct {
+	Path     string `json:"path"`
+	Writable bool   `json:"writable"`
+}
+
+type sandboxSpec struct {
+	Root  string        `json:"root"`
+	Binds []sandboxBind `json:"binds"`
+	Dir   string        `json:"dir"`
+	Path  string        `json:"path"`
+	Args  []string      `json:"args"`
+}
+
+// The directories that a command of the capsule can see in the sandbox
+func (cp *capsulePolicy) sandboxBinds(systemPaths []string, withHome bool) []sandboxBind {
+	binds := []sandboxBind{}
+	for _, p := range systemPaths {
+		binds = append(binds, sandboxBind{Path: p})
+	}
+	if cp.bin != "" {
+		if _, err := os.Stat(cp.bin); err == nil {
+			binds = append(binds, sandboxBind{Path: realDir(cp.bin)})
+		}
+	}
+	for _, m := range cp.mounts {
+		if m.virtual != "~" {
+			binds = append(binds, sandboxBind{Path: m.real})
+		}
+	}
+	for _, t := range cp.trustedLinks {
+		binds = append(binds, sandboxBind{Path: realDir(t)})
+	}
+	if withHome && cp.home != "" {
+		binds = append(binds, sandboxBind{Path: cp.home, Writable: true})
+	}
+
+	// Parents are bound before the directories inside of them
+	sort.SliceStable(binds, func(i, j int) bool {
+		return len(binds[i].Path) < len(binds[j].Path)
+	})
+
+	return binds
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	PR_CAPBSET_DROP     = 24
+	PR_SET_NO_NEW_PRIVS = 38
+)
+
+// Devices that commands commonly expect to find
+var SANDBOX_DEVICES = []string{"/dev/null", "/dev/zero", "/dev/random", "/dev/urandom"}
+
+// The empty directory where each sandbox mounts its own root filesystem
+var sandboxRoot = filepath.Join(os.TempDir(), "ssh-capsule-sandbox")
+
+func sandboxSupported() error {
+	if _, err := os.Stat("/proc/self/ns/user"); err != nil {
+		return fmt.Errorf("user namespaces aren't available: %s", err)
+	}
+	// Commands running as other users have to reach it too
+	if err := os.MkdirAll(sandboxRoot, 0755); err != nil {
+		return err
+	}
+	return os.Chmod(sandboxRoot, 0755)
+}
+
+// Change the command so that it runs inside of a new sandbox
+func sandboxCommand(c *exec.Cmd, binds []sandboxBind) error {
+	spec := sandboxSpec{
+		Root:  sandboxRoot,
+		Binds: binds,
+		Dir:   realDir(c.Dir),
+		Path:  c.Path,
+		Args:  c.Args,
+	}
+
+	// Only the real directories are bound in the sandbox
+	if p, err := filepath.EvalSymlinks(c.Path); err == nil {
+		spec.Path = p
+	}
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	c.Path = self
+	c.Args = []string{c.Args[0], SANDBOX_INIT, string(b)}
+	c.Dir = "/"
+
+	// The command is root in the namespace, which is the server's user or
+	//  the capsule's user outside of it.
+	var cred *syscall.Credential
+	if c.SysProcAttr != nil {
+		cred = c.SysProcAttr.Credential
+	}
+	attr := &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWNET,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+		},
+		GidMappingsEnableSetgroups: false,
+	}
+	if cred != nil {
+		// The supplementary groups are mapped after the primary group so
+		//  that the server's own groups can be dropped inside.
+		attr.UidMappings[0].HostID = int(cred.Uid)
+		attr.GidMappings[0].HostID = int(cred.Gid)
+		attr.GidMappingsEnableSetgroups = true
+		attr.Credential = &syscall.Credential{Groups: []uint32{}}
+		mapped := map[uint32]bool{cred.Gid: true}
+		for _, g := range cred.Groups {
+			if mapped[g] {
+				continue
+			}
+			mapped[g] = true
+			id := len(attr.GidMappings)
+			attr.GidMappings = append(attr.GidMappings, syscall.SysProcIDMap{ContainerID: id, HostID: int(g), Size: 1})
+			attr.Credential.Groups = append(attr.Credential.Groups, uint32(id))
+		}
+	}
+	c.SysProcAttr = attr
+
+	return nil
+}
+
+// The flags of the mount that a read-only remount has to keep
+func lockedMountFlags(p string) uintptr {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil {
+		return 0
+	}
+
+	flags := uintptr(0)
+	for _, f := range []struct {
+		st    int64
+		mount uintptr
+	}{
+		{0x2, syscall.MS_NOSUID},
+		{0x4, syscall.MS_NODEV},
+		{0x8, syscall.MS_NOEXEC},
+		{0x400, syscall.MS_NOATIME},
+		{0x800, syscall.MS_NODIRATIME},
+		{0x1000, syscall.MS_RELATIME},
+	} {
+		if int64(st.Flags)&f.st != 0 {
+			flags |= f.mount
+		}
+	}
+	return flags
+}
+
+func sandboxBindMount(root string, b sandboxBind) error {
+	target := filepath.Join(root, b.Path)
+
+	info, err := os.Lstat(b.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	// System directories like /bin are often links into /usr
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(b.Path)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(target); err == nil {
+			return nil
+		}
+		return os.Symlink(link, target)
+	}
+
+	if info.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else if _, err = os.Stat(target); os.IsNotExist(err) {
+		err = ioutil.WriteFile(target, nil, 0644)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := syscall.Mount(b.Path, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind %s: %s", b.Path, err)
+	}
+	if !b.Writable {
+		flags := syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | lockedMountFlags(b.Path)
+		if err := syscall.Mount("", target, "", flags, ""); err != nil {
+			return fmt.Errorf("read-only %s: %s", b.Path, err)
+		}
+	}
+
+	return nil
+}
+
+func sandboxSetup(spec sandboxSpec) error {
+	// Nothing mounted here is seen outside of the sandbox
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", spec.Root, "tmpfs", 0, "mode=0755"); err != nil {
+		return err
+	}
+
+	proc := filepath.Join(spec.Root, "proc")
+	if err := os.MkdirAll(proc, 0555); err != nil {
+		return err
+	}
+	if err := syscall.Mount("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return err
+	}
+
+	// A capsule can be inside of /tmp, so it is bound after this
+	tmp := filepath.Join(spec.Root, "tmp")
+	if err := os.MkdirAll(tmp, 01777); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", tmp, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777,size=64m"); err != nil {
+		return err
+	}
+
+	for _, b := range spec.Binds {
+		if err := sandboxBindMount(spec.Root, b); err != nil {
+			return err
+		}
+	}
+	for _, d := range SANDBOX_DEVICES {
+		if err := sandboxBindMount(spec.Root, sandboxBind{Path: d, Writable: true}); err != nil {
+			return err
+		}
+	}
+
+	old := filepath.Join(spec.Root, ".old")
+	if err := os.Mkdir(old, 0700); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(spec.Root, old); err != nil {
+		return err
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Unmount("/.old", syscall.MNT_DETACH); err != nil {
+		return err
+	}
+	os.Remove("/.old")
+
+	if err := syscall.Mount("", "/", "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, ""); err != nil {
+		return err
+	}
+
+	if err := os.Chdir(spec.Dir); err != nil {
+		return err
+	}
+
+	// The command is root in its user namespace, so it is left with no
+	//  capabilities at all.
+	last := 40
+	if b, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap"); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil {
+			last = n
+		}
+	}
+	for c := 0; c <= last; c++ {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, PR_CAPBSET_DROP, uintptr(c), 0); errno != 0 && errno != syscall.EINVAL {
+			return errno
+		}
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// The signals that the sandbox's first process passes on to the command
+var SANDBOX_SIGNALS = []os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2}
+
+// Run the command as a child and wait for it, passing on the signals that
+// the init receives and reaping any orphans left in the namespace. The exit
+// status is the command's, or 128 and the signal number if it was killed.
+func sandboxRun(spec sandboxSpec) int {
+	sig := make(chan os.Signal, len(SANDBOX_SIGNALS))
+	signal.Notify(sig, SANDBOX_SIGNALS...)
+
+	p, err := os.StartProcess(spec.Path, spec.Args, &os.ProcAttr{
+		Env:   os.Environ(),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", filepath.Base(spec.Path), err)
+		return 127
+	}
+
+	go func() {
+		for s := range sig {
+			p.Signal(s)
+		}
+	}()
+
+	for {
+		var ws syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &ws, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "sandbox: %s\n", err)
+			return 126
+		}
+		if pid != p.Pid {
+			continue
+		}
+		if ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
+		return ws.ExitStatus()
+	}
+}
+
+// The sandbox's first process, which sets up the namespaces and then runs
+// the command. As PID 1 of its namespace it only gets the signals that it
+// handles, so it stays to pass them on instead of becoming the command.
+func sandboxInit() {
+	spec := sandboxSpec{}
+	if len(os.Args) != 3 {
+		fmt.Fprintf(os.Stderr, "sandbox: missing specification\n")
+		os.Exit(126)
+	}
+	if err := json.Unmarshal([]byte(os.Args[2]), &spec); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %s\n", err)
+		os.Exit(126)
+	}
+
+	if err := sandboxSetup(spec); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %s\n", err)
+		os.Exit(126)
+	}
+
+	// The rest of the namespace is killed when this exits
+	os.Exit(sandboxRun(spec))
+}
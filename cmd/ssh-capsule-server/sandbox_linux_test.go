@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// The test binary sets up the sandbox in place of the server
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == SANDBOX_INIT {
+		sandboxInit()
+	}
+	os.Exit(m.Run())
+}
+
+func TestSandboxCommand(t *testing.T) {
+	if err := sandboxSupported(); err != nil {
+		t.Skip(err)
+	}
+
+	dir, err := ioutil.TempDir("", "sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir = realDir(dir)
+
+	content, home := filepath.Join(dir, "content"), filepath.Join(dir, "home")
+	writeCapsule(t, content, map[string]string{"index.gmi": "# Hello\n"})
+	writeCapsule(t, home, map[string]string{})
+	writeCapsule(t, filepath.Join(dir, "other"), map[string]string{"secret": ""})
+
+	run := func(script string) (string, int) {
+		c := exec.Command("/bin/sh", "-c", script)
+		c.Dir = content
+		binds := append([]sandboxBind{}, sandboxBind{Path: home, Writable: true})
+		for _, p := range DEFAULT_SANDBOX_PATHS {
+			binds = append(binds, sandboxBind{Path: p})
+		}
+		binds = append(binds, sandboxBind{Path: content})
+		if err := sandboxCommand(c, binds); err != nil {
+			t.Fatal(err)
+		}
+		out, err := c.CombinedOutput()
+		if c.ProcessState == nil {
+			t.Fatal(err)
+		}
+		return string(out), exitStatus(c.ProcessState)
+	}
+
+	if _, code := run("true"); code == 126 {
+		t.Skip("namespaces can't be created here")
+	}
+
+	if out, code := run("cat index.gmi && echo x >" + home + "/f"); code != 0 || out != "# Hello\n" {
+		t.Errorf("the command gave %d: %q", code, out)
+	}
+	if _, code := run("echo x >" + content + "/f"); code == 0 {
+		t.Errorf("the content was written")
+	}
+	if _, code := run("ls " + filepath.Join(dir, "other")); code == 0 {
+		t.Errorf("another directory can be seen")
+	}
+	// Only the init and the command itself can be seen
+	if out, _ := run("set -- /proc/[0-9]*; echo $#"); out != "2\n" {
+		t.Errorf("%q processes can be seen", out)
+	}
+
+	// Signals reach the command through the init
+	if _, code := run("kill -TERM 1; sleep 5"); code != 128+int(syscall.SIGTERM) {
+		t.Errorf("a signalled command gave %d", code)
+	}
+}
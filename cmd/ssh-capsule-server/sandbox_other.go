@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func sandboxSupported() error {
+	return fmt.Errorf("the sandbox is only available on Linux")
+}
+
+func sandboxCommand(c *exec.Cmd, binds []sandboxBind) error {
+	return sandboxSupported()
+}
+
+func sandboxInit() {
+	fmt.Fprintf(os.Stderr, "sandbox: %s\n", sandboxSupported())
+	os.Exit(126)
+}
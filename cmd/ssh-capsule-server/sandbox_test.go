@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSandboxBinds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir = realDir(dir)
+
+	content, big := filepath.Join(dir, "content"), filepath.Join(dir, "content", "big")
+	writeCapsule(t, big, map[string]string{"file": ""})
+	writeCapsule(t, filepath.Join(dir, "bin"), map[string]string{"tool": ""})
+	cp := testCapsule(t, content, mount{virtual: "/downloads", physical: big})
+	cp.bin = filepath.Join(dir, "bin")
+	cp.homes = filepath.Join(dir, "homes")
+	cp = cp.forAccount("acct")
+
+	binds := cp.sandboxBinds([]string{"/usr/lib", "/usr"}, false)
+	want := []sandboxBind{
+		{Path: "/usr"},
+		{Path: "/usr/lib"},
+		{Path: cp.bin},
+		{Path: content},
+		{Path: big},
+	}
+	if len(binds) != len(want) {
+		t.Fatalf("binds = %v, want %v", binds, want)
+	}
+	for i := range want {
+		if binds[i] != want[i] {
+			t.Errorf("bind %d = %v, want %v", i, binds[i], want[i])
+		}
+	}
+
+	// The home is the only writable bind, and only for commands that use it
+	binds = cp.sandboxBinds(nil, true)
+	writable := []string{}
+	for _, b := range binds {
+		if b.Writable {
+			writable = append(writable, b.Path)
+		}
+	}
+	if len(writable) != 1 || writable[0] != filepath.Join(dir, "homes", "acct") {
+		t.Errorf("writable binds are %q", writable)
+	}
+
+	// A capsule without a bin directory doesn't bind one
+	cp.bin = filepath.Join(dir, "missing")
+	for _, b := range cp.sandboxBinds(nil, false) {
+		if b.Path == cp.bin {
+			t.Errorf("the missing bin directory is bound")
+		}
+	}
+}
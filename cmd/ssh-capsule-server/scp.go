@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This is a built-in implementation of the legacy scp (rcp) protocol so that
+// file transfers don't need to run the system scp binary.
+//
+// Usage:
+// scp [-r] [-p] [-d] [-v] -f <path>...
+// scp [-r] [-p] [-d] [-v] -t <path>
+//
+
+type scpOptions struct {
+	source    bool
+	sink      bool
+	recursive bool
+	preserve  bool
+	targetDir bool
+}
+
+func parseScpArgs(args []string) (scpOptions, []string, error) {
+	opts := scpOptions{}
+
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		a := args[0]
+		args = args[1:]
+		if a == "--" {
+			break
+		}
+		for _, f := range a[1:] {
+			switch f {
+			case 'f':
+				opts.source = true
+			case 't':
+				opts.sink = true
+			case 'r':
+				opts.recursive = true
+			case 'p':
+				opts.preserve = true
+			case 'd':
+				opts.targetDir = true
+			case 'v':
+			default:
+				return opts, nil, fmt.Errorf("unsupported option -%c", f)
+			}
+		}
+	}
+
+	if opts.source == opts.sink {
+		return opts, nil, fmt.Errorf("exactly one of -f or -t is required")
+	}
+	if len(args) == 0 || (opts.sink && len(args) != 1) {
+		return opts, nil, fmt.Errorf("wrong number of paths")
+	}
+
+	return opts, args, nil
+}
+
+// Read the response from the other side, which is either a zero byte
+// or an error code followed by a message.
+func scpReadAck(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("scp: remote error: %s", strings.TrimSpace(msg))
+}
+
+func scpSendError(w io.Writer, fatal bool, msg string) {
+	code := byte(1)
+	if fatal {
+		code = 2
+	}
+	w.Write([]byte{code})
+	io.WriteString(w, "scp: "+msg+"\n")
+}
+
+// Serve files from the capsule to the client (scp -f)
+func scpSource(r *bufio.Reader, w io.Writer, opts scpOptions, paths []string, cp *capsulePolicy) error {
+	if err := scpReadAck(r); err != nil {
+		return err
+	}
+
+	var failed error
+	for _, p := range paths {
+		info, err := cp.stat(p)
+		if err != nil || !(info.Mode().IsRegular() || info.IsDir()) {
+			failed = fmt.Errorf("%s: No such file or directory", filepath.Base(p))
+			scpSendError(w, false, failed.Error())
+			continue
+		}
+		if info.IsDir() && !opts.recursive {
+			failed = fmt.Errorf("%s: not a regular file", filepath.Base(p))
+			scpSendError(w, false, failed.Error())
+			continue
+		}
+		if err := scpSendEntry(r, w, opts, p, info, cp); err != nil {
+			return err
+		}
+	}
+
+	return failed
+}
+
+func scpSendEntry(r *bufio.Reader, w io.Writer, opts scpOptions, p string, info os.FileInfo, cp *capsulePolicy) error {
+	if opts.preserve {
+		mt := info.ModTime().Unix()
+		fmt.Fprintf(w, "T%d 0 %d 0\n", mt, mt)
+		if err := scpReadAck(r); err != nil {
+			return err
+		}
+	}
+
+	if info.IsDir() {
+		fmt.Fprintf(w, "D%04o 0 %s\n", info.Mode().Perm(), info.Name())
+		if err := scpReadAck(r); err != nil {
+			return err
+		}
+
+		d, err := cp.openFile(p, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		entries, err := d.Readdir(-1)
+		d.Close()
+		if err != nil {
+			return err
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Name() < entries[j].Name()
+		})
+		for _, ei := range entries {
+			// Symbolic links and special files aren't sent so that the
+			//  transfer stays inside the capsule.
+			if !(ei.Mode().IsRegular() || ei.IsDir()) {
+				continue
+			}
+			if err := scpSendEntry(r, w, opts, filepath.Join(p, ei.Name()), ei, cp); err != nil {
+				return err
+			}
+		}
+
+		io.WriteString(w, "E\n")
+		return scpReadAck(r)
+	}
+
+	f, err := cp.openFile(p, os.O_RDONLY, 0)
+	if err != nil {
+		scpSendError(w, false, fmt.Sprintf("%s: %s", info.Name(), "Permission denied"))
+		return nil
+	}
+	defer f.Close()
+
+	fmt.Fprintf(w, "C%04o %d %s\n", info.Mode().Perm(), info.Size(), info.Name())
+	if err := scpReadAck(r); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, f, info.Size()); err != nil {
+		return err
+	}
+	w.Write([]byte{0})
+	return scpReadAck(r)
+}
+
+func scpValidName(name string) bool {
+	return name != "." && name != ".." && !strings.ContainsAny(name, "/") && validPath(name)
+}
+
+// Receive files from the client into the capsule (scp -t)
+func scpSink(r *bufio.Reader, w io.Writer, opts scpOptions, target string, cp *capsulePolicy, q *quotaTracker) error {
+	if cp.readOnly(target) {
+		scpSendError(w, true, "Read-only file system")
+		return fmt.Errorf("%s: read-only", cp.virtualPath(target))
+	}
+
+	info, err := cp.stat(target)
+	isDir := err == nil && info.IsDir()
+	if opts.targetDir && !isDir {
+		scpSendError(w, true, "target is not a directory")
+		return fmt.Errorf("%s: not a directory", filepath.Base(target))
+	}
+
+	w.Write([]byte{0})
+
+	dirs := []string{}
+	var mtime time.Time
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		} else if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return fmt.Errorf("protocol error: empty line")
+		}
+
+		// The directory that new entries go into is the most recent
+		//  one from a D line, or the target itself.
+		parent := target
+		if len(dirs) > 0 {
+			parent = dirs[len(dirs)-1]
+		}
+
+		switch line[0] {
+		case 1, 2:
+			return fmt.Errorf("scp: remote error: %s", line[1:])
+		case 'T':
+			var sec, usec, asec, ausec int64
+			if _, err := fmt.Sscanf(line, "T%d %d %d %d", &sec, &usec, &asec, &ausec); err != nil {
+				scpSendError(w, true, "protocol error: bad times")
+				return err
+			}
+			mtime = time.Unix(sec, 0)
+			w.Write([]byte{0})
+		case 'E':
+			if len(dirs) == 0 {
+				scpSendError(w, true, "protocol error: unexpected E")
+				return fmt.Errorf("protocol error: unexpected E")
+			}
+			dirs = dirs[:len(dirs)-1]
+			w.Write([]byte{0})
+		case 'C', 'D':
+			parts := strings.SplitN(line[1:], " ", 3)
+			if len(parts) != 3 {
+				scpSendError(w, true, "protocol error: bad header")
+				return fmt.Errorf("protocol error: bad header %q", line)
+			}
+			mode, err1 := strconv.ParseUint(parts[0], 8, 32)
+			size, err2 := strconv.ParseInt(parts[1], 10, 64)
+			name := parts[2]
+			if err1 != nil || err2 != nil || size < 0 || !scpValidName(name) {
+				scpSendError(w, true, "protocol error: bad header")
+				return fmt.Errorf("protocol error: bad header %q", line)
+			}
+			perm := os.FileMode(mode) & 0777
+
+			dest := parent
+			if len(dirs) > 0 || isDir {
+				dest = filepath.Join(parent, name)
+			}
+
+			// A nested name can lead into another mount. The entry is
+			//  checked again once its links have been followed.
+			if cp.readOnly(dest) {
+				scpSendError(w, true, fmt.Sprintf("%s: %s", name, "Read-only file system"))
+				return fmt.Errorf("%s: read-only", cp.virtualPath(dest))
+			}
+
+			// Only the change in the size of a file counts towards
+			//  the quota
+			before, after := usage{}, usage{size, 1}
+			if line[0] == 'D' {
+				after.bytes = 0
+			}
+			if info, err := cp.stat(dest); err == nil {
+				before = fileUsage(info)
+			}
+			if err := q.change(dest, before, after); err != nil {
+				scpSendError(w, true, fmt.Sprintf("%s: %s", name, "Disk quota exceeded"))
+				return err
+			}
+
+			// Only what is left of an entry that couldn't be written
+			//  still counts towards the quota.
+			failed := func() {
+				left := usage{}
+				if info, err := cp.stat(dest); err == nil {
+					left = fileUsage(info)
+				}
+				q.change(dest, after, left)
+			}
+
+			if line[0] == 'D' {
+				if !opts.recursive {
+					scpSendError(w, true, "received directory without -r")
+					return fmt.Errorf("received directory without -r")
+				}
+				if err := cp.mkdir(dest, perm|0700); err != nil && !os.IsExist(err) {
+					failed()
+					scpSendError(w, true, fmt.Sprintf("%s: %s", name, "Permission denied"))
+					return err
+				}
+				dirs = append(dirs, dest)
+				w.Write([]byte{0})
+				continue
+			}
+
+			if err := scpReceiveFile(r, w, dest, perm, size, cp); err != nil {
+				failed()
+				return err
+			}
+			if !mtime.IsZero() {
+				cp.chtimes(dest, mtime, mtime)
+				mtime = time.Time{}
+			}
+		default:
+			scpSendError(w, true, "protocol error: unknown message")
+			return fmt.Errorf("protocol error: unknown message %q", line)
+		}
+	}
+
+	return nil
+}
+
+// The file is opened without following a link in its name
+func scpReceiveFile(r *bufio.Reader, w io.Writer, dest string, perm os.FileMode, size int64, cp *capsulePolicy) error {
+	f, err := cp.openFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		scpSendError(w, true, fmt.Sprintf("%s: %s", filepath.Base(dest), "Permission denied"))
+		return err
+	}
+	defer f.Close()
+
+	w.Write([]byte{0})
+
+	if _, err := io.CopyN(f, r, size); err != nil {
+		return err
+	}
+	if err := scpReadAck(r); err != nil {
+		return err
+	}
+
+	w.Write([]byte{0})
+	return nil
+}
+
+// Run the scp built-in command, returning the exit code.
+func scpCommand(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []string, cp *capsulePolicy, q *quotaTracker) int {
+	opts, paths, err := parseScpArgs(args)
+	if err != nil {
+		log.Printf("ERROR: scp: %s\n", err)
+		fmt.Fprintf(stderr, "scp: %s\n", err)
+		return 1
+	}
+
+	r := bufio.NewReader(stdin)
+	if opts.source {
+		err = scpSource(r, stdout, opts, paths, cp)
+	} else {
+		err = scpSink(r, stdout, opts, paths[0], cp, q)
+	}
+
+	if qerr, ok := err.(*quotaError); ok {
+		log.Printf("ERROR: scp: %s\n", qerr)
+		fmt.Fprintf(stderr, "scp: %s\n", qerr)
+		return QUOTA_EXIT_STATUS
+	} else if err != nil {
+		log.Printf("ERROR: scp: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseScpArgs(t *testing.T) {
+	tests := []struct {
+		args  string
+		paths int
+		ok    bool
+	}{
+		{"-t /up", 1, true},
+		{"-r -p -t -- /up", 1, true},
+		{"-rpd -t /up", 1, true},
+		{"-f /a /b", 2, true},
+		{"-f", 0, false},
+		{"-t /a /b", 0, false},
+		{"-f -t /a", 0, false},
+		{"-x -t /a", 0, false},
+		{"/a", 0, false},
+	}
+
+	for _, tt := range tests {
+		_, paths, err := parseScpArgs(strings.Fields(tt.args))
+		if tt.ok && (err != nil || len(paths) != tt.paths) {
+			t.Errorf("parseScpArgs(%q) = %v, %v", tt.args, paths, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("parseScpArgs(%q) succeeded, want an error", tt.args)
+		}
+	}
+}
+
+func TestScpSink(t *testing.T) {
+	tests := []struct {
+		target string
+		input  string
+		ok     bool
+		want   string
+		absent string
+	}{
+		{"root/up", "C0644 5 new\ndata\n\x00", true, "root/up/new", ""},
+		{"root/up/named", "C0644 5 new\ndata\n\x00", true, "root/up/named", ""},
+		{"root/up", "D0755 0 sub\nC0644 5 f\ndata\n\x00E\n", true, "root/up/sub/f", ""},
+		{"root/up", "D0755 0 ahead\nC0644 5 f\ndata\n\x00E\n", false, "", "root/a/f"},
+		{"root", "D0755 0 evil\nC0644 5 escape\ndata\n\x00E\n", false, "", "outside/escape"},
+		{"root", "D0755 0 trusted\nC0644 5 new\ndata\n\x00E\n", false, "", "trusted/new"},
+		{"root/up", "C0644 5 ulink\nnope\n\x00", false, "", ""},
+		{"root/up", "C0644 5 ../x\ndata\n\x00", false, "", "root/x"},
+		{"root/up", "C0644 5 new\ndata\n\x00E\n", false, "", ""},
+		{"root", "D0755 0 ro\nC0644 5 new\ndata\n\x00E\n", false, "", "root/a/new"},
+	}
+
+	for _, tt := range tests {
+		dir, cp := confineTree(t)
+		root := filepath.Join(dir, "root")
+		if err := cp.setMounts([]mount{{virtual: "/", physical: root}, {virtual: "/ro", physical: filepath.Join(root, "a"), readOnly: true}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(filepath.Join(root, "a"), filepath.Join(root, "ro")); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, "up/kept"), []byte("data\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("kept", filepath.Join(root, "up/ulink")); err != nil {
+			t.Fatal(err)
+		}
+
+		r := bufio.NewReader(strings.NewReader(tt.input))
+		err := scpSink(r, &bytes.Buffer{}, scpOptions{sink: true, recursive: true}, filepath.Join(dir, tt.target), cp, nil)
+		if tt.ok && err != nil {
+			t.Errorf("scp -t %s with %q failed: %s", tt.target, tt.input, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("scp -t %s with %q succeeded, want an error", tt.target, tt.input)
+		}
+
+		if tt.want != "" {
+			if b, err := ioutil.ReadFile(filepath.Join(dir, tt.want)); err != nil || string(b) != "data\n" {
+				t.Errorf("scp -t %s with %q: %s has %q, %v", tt.target, tt.input, tt.want, b, err)
+			}
+		}
+		if tt.absent != "" {
+			if _, err := os.Lstat(filepath.Join(dir, tt.absent)); err == nil {
+				t.Errorf("scp -t %s with %q created %s", tt.target, tt.input, tt.absent)
+			}
+		}
+		for _, f := range []string{"a/file", "up/kept"} {
+			if b, _ := ioutil.ReadFile(filepath.Join(root, f)); string(b) != "data\n" {
+				t.Errorf("scp -t %s with %q changed %s to %q", tt.target, tt.input, f, b)
+			}
+		}
+
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"github.com/pkg/sftp"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// The SFTP subsystem serves the capsule content directory as the root of a
+// virtual filesystem. It is enabled with a "sftp" line in a commands file and
+// is read-only unless a commands file that applies to the key also grants
+// write access to part of the capsule:
+//
+// sftp
+// sftp -w /uploads
+//
+
+type sftpHandler struct {
+	cp       *capsulePolicy
+	writable []sftpWritable
+	q        *quotaTracker
+}
+
+// A part of the capsule that sftp can write to and the user of the commands
+// file that allowed it, who gets what is created there
+type sftpWritable struct {
+	path  string
+	owner *credential
+}
+
+func (w sftpWritable) String() string {
+	return w.path
+}
+
+type listerat []os.FileInfo
+
+func (l listerat) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Find out whether sftp is permitted for this key and which virtual paths
+// it can write to.
+func sftpAccess(cp *capsulePolicy) (bool, []sftpWritable) {
+	allowed := false
+	writable := []sftpWritable{}
+
+	for _, t := range cp.templates() {
+		if t.args[0].literal != "sftp" {
+			continue
+		}
+
+		if len(t.args) == 1 {
+			allowed = true
+		} else if len(t.args) == 3 && t.args[1].kind == argLiteral && t.args[1].literal == "-w" && t.args[2].kind == argLiteral {
+			allowed = true
+			writable = append(writable, sftpWritable{path.Clean("/" + t.args[2].literal), cp.credential(t)})
+		}
+	}
+
+	return allowed, writable
+}
+
+func (h *sftpHandler) physical(p string) string {
+	return pathMatch(p, h.cp)
+}
+
+// The capsule policy that writes to the virtual path go through, or nil if
+// the path isn't writable
+func (h *sftpHandler) writer(p string) *capsulePolicy {
+	p = path.Clean("/" + p)
+	if m := h.cp.mountFor(p); m == nil || m.readOnly {
+		return nil
+	}
+	for _, w := range h.writable {
+		if w.path == "/" || p == w.path || strings.HasPrefix(p, w.path+"/") {
+			return h.cp.ownedBy(w.owner)
+		}
+	}
+	return nil
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, err := h.cp.openFile(h.physical(r.Filepath), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	cp := h.writer(r.Filepath)
+	if cp == nil {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+
+	pflags := r.Pflags()
+	flags := os.O_WRONLY
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+
+	p := h.physical(r.Filepath)
+	info, err := cp.stat(p)
+	created := usage{}
+	if os.IsNotExist(err) && pflags.Creat {
+		created.files = 1
+		if err := h.q.charge(p, created); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := cp.openFile(p, flags, 0644)
+	if err != nil {
+		h.q.release(p, created)
+		return nil, err
+	}
+	if h.q == nil {
+		return f, nil
+	}
+
+	size := int64(0)
+	if info != nil && !pflags.Trunc {
+		size = info.Size()
+	} else if info != nil {
+		h.q.release(p, usage{info.Size(), 0})
+	}
+	return &quotaFile{File: f, q: h.q, size: size}, nil
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	cp := h.writer(r.Filepath)
+	if cp == nil {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+
+	p := h.physical(r.Filepath)
+
+	switch r.Method {
+	case "Setstat":
+		attrs := r.Attributes()
+		flags := r.AttrFlags()
+		if flags.Permissions {
+			if err := cp.chmod(p, attrs.FileMode()&0777); err != nil {
+				return err
+			}
+		}
+		if flags.Acmodtime {
+			if err := cp.chtimes(p, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0)); err != nil {
+				return err
+			}
+		}
+		if flags.Size {
+			info, err := cp.stat(p)
+			if err != nil {
+				return err
+			}
+			before, after := usage{info.Size(), 0}, usage{int64(attrs.Size), 0}
+			if err := h.q.change(p, before, after); err != nil {
+				return err
+			}
+			if err := cp.truncate(p, int64(attrs.Size)); err != nil {
+				h.q.change(p, after, before)
+				return err
+			}
+		}
+		return nil
+	case "Rename":
+		if h.writer(r.Target) == nil {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		target := h.physical(r.Target)
+		replaced, err := cp.stat(target)
+		if err := cp.rename(p, target); err != nil {
+			return err
+		}
+		if err == nil {
+			h.q.release(target, fileUsage(replaced))
+		}
+		return nil
+	case "Rmdir", "Remove":
+		info, err := cp.stat(p)
+		if err != nil {
+			return err
+		}
+		if err := cp.remove(p); err != nil {
+			return err
+		}
+		h.q.release(p, fileUsage(info))
+		return nil
+	case "Mkdir":
+		if err := h.q.charge(p, usage{0, 1}); err != nil {
+			return err
+		}
+		if err := cp.mkdir(p, 0755); err != nil {
+			h.q.release(p, usage{0, 1})
+			return err
+		}
+		return nil
+	}
+
+	// Links could point outside of the capsule
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	p := h.physical(r.Filepath)
+
+	switch r.Method {
+	case "List":
+		entries, err := h.cp.readDir(p)
+		if err != nil {
+			return nil, err
+		}
+		return listerat(entries), nil
+	case "Stat":
+		info, err := h.cp.stat(p)
+		if err != nil {
+			return nil, err
+		}
+		return listerat{info}, nil
+	}
+
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *sftpHandler) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	// Resolved paths have had their links followed already
+	info, err := h.cp.stat(h.physical(r.Filepath))
+	if err != nil {
+		return nil, err
+	}
+	return listerat{info}, nil
+}
+
+// Serve the sftp protocol over the session, returning the exit code.
+func sftpCommand(rwc io.ReadWriteCloser, cp *capsulePolicy, writable []sftpWritable, q *quotaTracker) int {
+	h := &sftpHandler{cp: cp, writable: writable, q: q}
+	server := sftp.NewRequestServer(rwc, sftp.Handlers{
+		FileGet:  h,
+		FilePut:  h,
+		FileCmd:  h,
+		FileList: h,
+	})
+	defer server.Close()
+
+	if err := server.Serve(); err != nil && err != io.EOF {
+		return 1
+	}
+	if q.overQuota() {
+		return QUOTA_EXIT_STATUS
+	}
+
+	return 0
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"github.com/pkg/sftp"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// Serve the content over a pipe to a client that can write to the paths
+func sftpClient(t *testing.T, cp *capsulePolicy, writable []sftpWritable) *sftp.Client {
+	server, conn := net.Pipe()
+	go sftpCommand(server, cp, writable, nil)
+
+	client, err := sftp.NewClientPipe(conn, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestSftp(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links need privileges on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := filepath.Join(dir, "content")
+	for _, d := range []string{"content/a", "content/up", "outside"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"content/a/file", "outside/secret"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte("data\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(dir, "outside"), filepath.Join(content, "up/evil")); err != nil {
+		t.Fatal(err)
+	}
+
+	client := sftpClient(t, testCapsule(t, content), []sftpWritable{{path: "/up"}})
+	defer client.Close()
+
+	f, err := client.Open("/a/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(b) != "data\n" {
+		t.Errorf("/a/file has %q, %v", b, err)
+	}
+
+	entries, err := client.ReadDir("/")
+	if err != nil || len(entries) != 2 {
+		t.Errorf("/ has %d entries, %v", len(entries), err)
+	}
+
+	if f, err := client.Open("/../outside/secret"); err == nil {
+		f.Close()
+		t.Errorf("read a file outside of the content")
+	}
+
+	// Writes are only allowed below /up and never through a link
+	if f, err := client.Create("/up/new"); err != nil {
+		t.Errorf("creating /up/new failed: %s", err)
+	} else {
+		f.Write([]byte("data\n"))
+		f.Close()
+	}
+	if err := client.Mkdir("/up/sub"); err != nil {
+		t.Errorf("mkdir /up/sub failed: %s", err)
+	}
+	if err := client.Rename("/up/new", "/up/sub/new"); err != nil {
+		t.Errorf("rename in /up failed: %s", err)
+	}
+
+	for _, p := range []string{"/a/new", "/new", "/up/evil/new", "/up/evil/secret"} {
+		if f, err := client.Create(p); err == nil {
+			f.Close()
+			t.Errorf("created %s", p)
+		}
+	}
+	if err := client.Rename("/up/sub/new", "/a/new"); err == nil {
+		t.Errorf("renamed out of /up")
+	}
+	if err := client.Remove("/a/file"); err == nil {
+		t.Errorf("removed /a/file")
+	}
+	if err := client.Chmod("/up/evil/secret", 0777); err == nil {
+		t.Errorf("changed the mode through a link")
+	}
+
+	if _, err := os.Stat(filepath.Join(content, "up/sub/new")); err != nil {
+		t.Errorf("up/sub/new is missing: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "outside/new")); err == nil {
+		t.Errorf("outside/new was created")
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "outside/secret")); string(b) != "data\n" {
+		t.Errorf("outside/secret was changed to %q", b)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// On SIGTERM or SIGINT the server stops accepting connections and waits up
+// to the --shutdown-grace period for the running sessions to finish. Then
+// the commands that are still running get SIGTERM, and SIGKILL if they
+// haven't exited after SHUTDOWN_KILL_DELAY, before the remaining connections
+// are closed. A second signal ends the grace period early.
+
+const SHUTDOWN_KILL_DELAY = 5 * time.Second
+
+// The external commands that are running, so that they can be stopped
+type processSet struct {
+	mutex sync.Mutex
+	stops map[*exec.Cmd]func(error)
+	done  chan struct{}
+}
+
+var running = &processSet{stops: map[*exec.Cmd]func(error){}}
+
+func (ps *processSet) add(c *exec.Cmd, stop func(error)) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.stops[c] = stop
+}
+
+func (ps *processSet) remove(c *exec.Cmd) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	delete(ps.stops, c)
+	if len(ps.stops) == 0 && ps.done != nil {
+		close(ps.done)
+		ps.done = nil
+	}
+}
+
+// Ask every command to exit, killing those that haven't after the delay
+func (ps *processSet) terminate(delay time.Duration) {
+	ps.mutex.Lock()
+	if len(ps.stops) == 0 {
+		ps.mutex.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	ps.done = done
+	for c := range ps.stops {
+		terminateProcessGroup(c)
+	}
+	ps.mutex.Unlock()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(delay):
+	}
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	for _, stop := range ps.stops {
+		stop(fmt.Errorf("server shut down"))
+	}
+}
+
+// Shut the server down gracefully on a signal, closing the returned channel
+// once it is done.
+func handleShutdown(server *ssh.Server, grace time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		defer close(done)
+
+		s := <-sig
+		log.Printf("Shutting down on %s, waiting up to %s for %d sessions\n", s, grace, metrics.active())
+
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		go func() {
+			select {
+			case s := <-sig:
+				log.Printf("Ending the grace period on %s\n", s)
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		if err := server.Shutdown(ctx); err == nil || err != context.DeadlineExceeded && err != context.Canceled {
+			log.Printf("All sessions finished\n")
+			return
+		}
+
+		cut := metrics.active()
+		running.terminate(SHUTDOWN_KILL_DELAY)
+		server.Close()
+		log.Printf("Shut down with %d sessions cut off\n", cut)
+	}()
+
+	return done
+}
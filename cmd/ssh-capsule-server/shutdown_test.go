@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTerminateProcesses(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands need a Unix shell")
+	}
+
+	running.terminate(time.Second)
+
+	codes := make(chan int, 2)
+	for _, script := range []string{
+		"sleep 30 & wait",
+		"trap '' TERM; while :; do sleep 1; done",
+	} {
+		go func(script string) {
+			codes <- runProcess(newProcessSession(""), exec.Command("sh", "-c", script), processLimits{}, nil, nil)
+		}(script)
+	}
+	for {
+		running.mutex.Lock()
+		n := len(running.stops)
+		running.mutex.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Let the shells set up their traps
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	running.terminate(200 * time.Millisecond)
+	got := map[int]bool{<-codes: true, <-codes: true}
+	if !got[128+int(syscall.SIGTERM)] || !got[128+int(syscall.SIGKILL)] {
+		t.Errorf("the commands exited with %v", got)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("terminating took %s", d)
+	}
+	running.mutex.Lock()
+	defer running.mutex.Unlock()
+	if len(running.stops) != 0 {
+		t.Errorf("%d commands are still running", len(running.stops))
+	}
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"github.com/gliderlabs/ssh"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHandleShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &ssh.Server{Handler: func(s ssh.Session) {}}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+
+	done := handleShutdown(server, time.Second)
+	time.Sleep(100 * time.Millisecond)
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server didn't shut down")
+	}
+	if err := <-served; err != ssh.ErrServerClosed {
+		t.Errorf("the server stopped with %v", err)
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Errorf("the server still accepts connections")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A capsule's commands can run as a dedicated Unix user instead of the
+// server's user so that one capsule can't touch the files of another. The
+// optional user file in the capsule directory has the user for the capsule
+// and, for commands from a group's commands file, the user for that group.
+// The user can be followed by its primary group and then its supplementary
+// groups, which are otherwise those of the user in the system's group file:
+//
+// capsule alice
+// group editor alice:www-data git
+//
+// The server must run as root or hold CAP_SETUID and CAP_SETGID for this.
+
+type credential struct {
+	uid    uint32
+	gid    uint32
+	groups []uint32
+}
+
+func (c *credential) String() string {
+	if c == nil {
+		return "server user"
+	}
+	groups := []string{}
+	for _, g := range c.groups {
+		groups = append(groups, strconv.FormatUint(uint64(g), 10))
+	}
+	return fmt.Sprintf("uid=%d gid=%d groups=%s", c.uid, c.gid, strings.Join(groups, ","))
+}
+
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err
+}
+
+func lookupGroupID(name string) (uint32, error) {
+	if id, err := parseID(name); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return parseID(g.Gid)
+}
+
+// Look up a user given as <user>[:<group>], by name or number, with the
+// supplementary groups.
+func lookupCredential(spec string, groups []string) (*credential, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	c := &credential{}
+
+	u, err := user.Lookup(parts[0])
+	if err != nil {
+		u, err = user.LookupId(parts[0])
+	}
+	if err == nil {
+		if c.uid, err = parseID(u.Uid); err != nil {
+			return nil, err
+		}
+		if c.gid, err = parseID(u.Gid); err != nil {
+			return nil, err
+		}
+	} else if c.uid, err = parseID(parts[0]); err != nil {
+		return nil, fmt.Errorf("unknown user %q", parts[0])
+	} else if len(parts) == 1 {
+		return nil, fmt.Errorf("user %s has no entry so it needs a group", parts[0])
+	}
+
+	if len(parts) == 2 {
+		if c.gid, err = lookupGroupID(parts[1]); err != nil {
+			return nil, fmt.Errorf("unknown group %q", parts[1])
+		}
+	}
+
+	if groups == nil && u != nil {
+		if groups, err = u.GroupIds(); err != nil {
+			return nil, err
+		}
+	}
+	for _, g := range groups {
+		id, err := lookupGroupID(g)
+		if err != nil {
+			return nil, fmt.Errorf("unknown group %q", g)
+		}
+		c.groups = append(c.groups, id)
+	}
+
+	return c, nil
+}
+
+func readUsers(capsulePath string) (*credential, map[string]*credential, error) {
+	groupUsers := map[string]*credential{}
+
+	uf := filepath.Join(capsulePath, "user")
+	lines, err := readLines(uf)
+	if os.IsNotExist(err) {
+		return nil, groupUsers, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	var capsuleUser *credential
+	for i, l := range lines {
+		if len(strings.TrimSpace(l)) == 0 || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		fields := strings.Fields(l)
+		var group string
+		switch {
+		case fields[0] == "capsule" && len(fields) >= 2:
+			fields = fields[1:]
+		case fields[0] == "group" && len(fields) >= 3:
+			group = fields[1]
+			fields = fields[2:]
+		default:
+			return nil, nil, fmt.Errorf("%s:%d: invalid user %q", uf, i+1, l)
+		}
+
+		var groups []string
+		if len(fields) > 1 {
+			groups = fields[1:]
+		}
+		c, err := lookupCredential(fields[0], groups)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %s", uf, i+1, err)
+		}
+
+		if group == "" {
+			capsuleUser = c
+		} else {
+			groupUsers[group] = c
+		}
+	}
+
+	return capsuleUser, groupUsers, nil
+}
+
+// The user that runs the command of the template, or nil for the server's
+// own user.
+func (cp *capsulePolicy) credential(t *commandTemplate) *credential {
+	if g := strings.TrimPrefix(t.file, "commands-"); g != t.file {
+		if c, ok := cp.groupUsers[g]; ok {
+			return c
+		}
+	}
+	return cp.user
+}
+
+// A copy of the capsule policy that gives the files and directories that the
+// server creates to the user, or the policy itself for the server's user
+func (cp *capsulePolicy) ownedBy(owner *credential) *capsulePolicy {
+	if owner == nil {
+		return cp
+	}
+	ocp := *cp
+	ocp.owner = owner
+	return &ocp
+}
+
+func userLines(cp *capsulePolicy) []string {
+	lines := []string{"capsule " + cp.user.String()}
+	for g, c := range cp.groupUsers {
+		lines = append(lines, "group "+g+" "+c.String())
+	}
+	return lines
+}
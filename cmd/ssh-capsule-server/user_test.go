@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if c, groups, err := readUsers(dir); c != nil || len(groups) != 0 || err != nil {
+		t.Errorf("without a user file got %v, %v, %v", c, groups, err)
+	}
+
+	// Numbers that have no entry in the system's files are used as they are
+	writeCapsule(t, dir, map[string]string{
+		"user": "# users\n\ncapsule 4000000:4000000\ngroup editor 4000001:4000000 4000002 4000003\n",
+	})
+	c, groups, err := readUsers(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == nil || c.uid != 4000000 || c.gid != 4000000 || len(c.groups) != 0 {
+		t.Errorf("capsule user is %s", c)
+	}
+	if e := groups["editor"]; e == nil || e.uid != 4000001 || !reflect.DeepEqual(e.groups, []uint32{4000002, 4000003}) {
+		t.Errorf("editor user is %s", e)
+	}
+
+	for _, l := range []string{
+		"capsule",
+		"group editor",
+		"owner 4000000:4000000",
+		"capsule 4000000",
+		"capsule no-such-user-here",
+		"capsule 4000000:no-such-group-here",
+	} {
+		writeCapsule(t, dir, map[string]string{"user": "\n" + l + "\n"})
+		if _, _, err := readUsers(dir); err == nil || !strings.Contains(err.Error(), "user:2:") {
+			t.Errorf("%q gave %v, want an error with its line", l, err)
+		}
+	}
+}
+
+func TestCapsuleCredential(t *testing.T) {
+	capsuleUser, editor := &credential{uid: 1}, &credential{uid: 2}
+	cp := &capsulePolicy{user: capsuleUser, groupUsers: map[string]*credential{"editor": editor}}
+
+	for file, want := range map[string]*credential{
+		"commands":        capsuleUser,
+		"commands-editor": editor,
+		"commands-other":  capsuleUser,
+	} {
+		if c := cp.credential(&commandTemplate{file: file}); c != want {
+			t.Errorf("%s runs as %s, want %s", file, c, want)
+		}
+	}
+
+	if cp.ownedBy(nil) != cp {
+		t.Errorf("the server's user copied the policy")
+	}
+	if ocp := cp.ownedBy(editor); ocp.owner != editor || cp.owner != nil {
+		t.Errorf("owners are %s and %s", ocp.owner, cp.owner)
+	}
+}
@@ -6,5 +6,7 @@ require (
 	git.sr.ht/~yotam/go-gemini v0.0.0-20191116204306-8ebb75240eef
 	github.com/alecthomas/kong v0.2.17
 	github.com/gliderlabs/ssh v0.3.3
+	github.com/pkg/sftp v1.13.4
 	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
+	golang.org/x/sys v0.0.0-20210616094352-59db8d763f22
 )